@@ -2,9 +2,14 @@ package main
 
 import (
 	// Standard library
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"syscall"
 
 	// Internal packages
 	"github.com/deuill/mash/service"
@@ -13,42 +18,171 @@ import (
 	"github.com/rakyll/globalconf"
 )
 
+// Build information, set at build time via linker flags, e.g. '-X main.version=1.2.0'.
+var (
+	version = "unknown"
+	commit  = ""
+	date    = ""
+)
+
 // Entry point for Mash, this sets up global configuration and starts internal services.
 func main() {
+	// Command-line flags for bootstrapping configuration. These are parsed separately from, and
+	// before, any service configuration, and take precedence over their environment counterparts.
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configFile := fs.String("config", "", "The configuration file to load")
+	envPrefix := fs.String("env-prefix", "MASH_", "The prefix for configuration environment variables")
+	cpuProfile := fs.String("cpu-profile", "", "The file to write a CPU profile to, until shutdown")
+	memProfile := fs.String("mem-profile", "", "The file to write a memory profile to, on shutdown")
+	showVersion := fs.Bool("version", false, "Print build information and exit")
+
+	fs.Parse(os.Args[1:])
+
+	service.Build.Version, service.Build.Commit, service.Build.Date = version, commit, date
+	if *showVersion {
+		printVersion()
+		return
+	}
+
+	// Profile CPU usage for the lifetime of the process, if requested, e.g. for measuring the cost of
+	// processing images under representative load.
+	if *cpuProfile != "" {
+		if err := startProfile(*cpuProfile); err != nil {
+			fmt.Println("Error starting CPU profile:", err)
+			os.Exit(1)
+		}
+	}
+
 	// Allow one to override the default configuration file location using the MASH_CONFIG env
 	// variable. By definition, this variable exists outside of the configuration file and as such
 	// doesn't follow the same semantics as other configuration variables.
-	configFile := os.Getenv("MASH_CONFIG")
-	if configFile == "" {
-		configFile = "/etc/mash/mash.conf"
+	if *configFile == "" {
+		*configFile = os.Getenv("MASH_CONFIG")
+	}
+
+	if *configFile == "" {
+		*configFile = "/etc/mash/mash.conf"
 	}
 
 	// Initialize configuration, reading from environment variables using a 'MASH_' prefix first,
 	// then moving to a static configuration file, usually located in '/etc/mash/mash.conf'.
-	conf, err := globalconf.NewWithOptions(&globalconf.Options{configFile, "MASH_"})
+	conf, err := loadConfig(*configFile, *envPrefix)
 	if err != nil {
 		fmt.Println("Error loading configuration:", err)
 		os.Exit(1)
 	}
 
+	// Flags registered along with services are parsed once, and any values that may be reloaded are
+	// parsed by services themselves.
 	conf.ParseAll()
+	if err = service.Reload(conf.ParseSet); err != nil {
+		fmt.Printf("Error loading configuration:\n%s\n", err)
+		os.Exit(1)
+	}
+
 	fmt.Print("Starting server... ")
 
 	// Initialize HTTP and attached services.
-	err = service.Init()
-	if err != nil {
+	if err := service.Init(); err != nil {
 		fmt.Printf("error initializing services:\n%s\n", err)
 		os.Exit(1)
 	}
 
 	fmt.Println("done.")
 
-	// Listen for and terminate Mash on SIGKILL or SIGINT signals.
-	sigStop := make(chan os.Signal)
-	signal.Notify(sigStop, os.Interrupt, os.Kill)
+	// Listen for and terminate Mash on SIGTERM or SIGINT signals, and reload configuration on SIGHUP
+	// signals. The channel is buffered so that signals delivered before we start waiting on it are
+	// not dropped.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			fmt.Print("Reloading configuration... ")
+
+			// Configuration values are parsed into new variables by each service, and values in use
+			// are never changed in place.
+			conf, err := loadConfig(*configFile, *envPrefix)
+			if err != nil {
+				fmt.Printf("error loading configuration:\n%s\n", err)
+				continue
+			}
 
-	select {
-	case <-sigStop:
-		fmt.Println("Shutting down server...")
+			if err = service.Reload(conf.ParseSet); err != nil {
+				fmt.Printf("error reloading services:\n%s\n", err)
+				continue
+			}
+
+			fmt.Println("done.")
+		default:
+			fmt.Println("Shutting down server...")
+			if err := service.Shutdown(); err != nil {
+				fmt.Println("Error shutting down server:", err)
+				os.Exit(1)
+			}
+
+			if *cpuProfile != "" {
+				pprof.StopCPUProfile()
+			}
+
+			if *memProfile != "" {
+				if err := writeMemProfile(*memProfile); err != nil {
+					fmt.Println("Error writing memory profile:", err)
+					os.Exit(1)
+				}
+			}
+
+			return
+		}
 	}
 }
+
+// Prints build information, along with the versions of any libraries linked by services.
+func printVersion() {
+	fmt.Printf("mash %s (commit %s, built %s)\n", service.Build.Version, service.Build.Commit, service.Build.Date)
+
+	names := make([]string, 0, len(service.Build.Libraries))
+	for name := range service.Build.Libraries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s %s\n", name, service.Build.Libraries[name])
+	}
+}
+
+// Reads configuration from file and environment, for parsing into the configuration values of
+// registered services.
+func loadConfig(file, prefix string) (*globalconf.GlobalConf, error) {
+	return globalconf.NewWithOptions(&globalconf.Options{file, prefix})
+}
+
+// Starts profiling CPU usage, writing the profile to the file given until profiling is stopped.
+func startProfile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	if err = pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Writes a profile of heap allocations to the file given, as of the most recent garbage collection.
+func writeMemProfile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
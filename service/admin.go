@@ -0,0 +1,51 @@
+package service
+
+import (
+	// Standard library
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RegisterAdmin registers handlers for administrative tasks attached to a service. Handlers are made
+// available under the '/admin' path, followed by the service name and path specified in each handler,
+// and require the configured administrative token to be passed as a bearer token in the request
+// 'Authorization' header. The service must have been registered beforehand.
+func RegisterAdmin(name string, handlers []Handler) error {
+	if _, exists := services[name]; !exists {
+		return fmt.Errorf("Service '%s' does not exist, unable to register administrative handlers", name)
+	}
+
+	for _, h := range handlers {
+		path := "/admin/" + name + h.Path
+		router.Handle(h.Method, path, wrap(authorize(h.Handle)))
+		services[name] = append(services[name], Route{h.Method, path})
+	}
+
+	return nil
+}
+
+// Wraps handler method with a check for the administrative token, returning an error if the request
+// does not contain the correct token.
+func authorize(handle HandleFunc) HandleFunc {
+	return func(w http.ResponseWriter, r *http.Request, p Params) (*Response, error) {
+		adminToken := *getConfig().adminToken
+		if adminToken == "" {
+			return nil, NewError(http.StatusForbidden, CodeForbidden, "administrative handlers are disabled")
+		}
+
+		// Tokens are only accepted as bearer tokens, and the token itself is never accepted on its own.
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return nil, NewError(http.StatusUnauthorized, CodeUnauthorized, "invalid or missing administrative token")
+		}
+
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			return nil, NewError(http.StatusUnauthorized, CodeUnauthorized, "invalid or missing administrative token")
+		}
+
+		return handle(w, r, p)
+	}
+}
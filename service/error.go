@@ -0,0 +1,53 @@
+package service
+
+import (
+	// Standard library
+	"fmt"
+	"net/http"
+)
+
+// Machine-readable error codes, returned as part of JSON error responses.
+const (
+	CodeError         = "error"          // A generic error, returned for errors without a code.
+	CodeNotFound      = "not_found"      // The requested resource does not exist.
+	CodeInvalidParams = "invalid_params" // The request parameters are malformed or invalid.
+	CodeSourceError   = "source_error"   // The request source could not be accessed.
+	CodeProcessError  = "process_error"  // The request could not be processed.
+	CodeInvalidImage  = "invalid_image"  // The requested image is corrupt or of an unknown type.
+	CodeUnsupported   = "unsupported"    // The requested image is of a type that cannot be loaded.
+	CodeEmptyImage    = "empty_image"    // The requested image is empty or truncated at the source.
+	CodeTimeout       = "timeout"        // The request could not be processed in time.
+	CodeUnavailable   = "unavailable"    // The request source is temporarily unavailable.
+	CodeUnauthorized  = "unauthorized"   // The request is missing valid credentials.
+	CodeForbidden     = "forbidden"      // The request is not allowed.
+	CodeConflict      = "conflict"       // The request conflicts with an operation already in progress.
+)
+
+// Error represents an error with a stable, machine-readable code attached, which allows clients to
+// handle errors programmatically.
+type Error struct {
+	Status  int    // The HTTP response code.
+	Code    string // The machine-readable error code, e.g. 'not_found'.
+	Message string // The human-readable error message.
+}
+
+// Error returns the human-readable message for the error.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewError returns an error with the HTTP response code and machine-readable code provided, and a
+// message formatted according to the format specifier.
+func NewError(status int, code, format string, a ...interface{}) *Error {
+	return &Error{Status: status, Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Returns the HTTP response code and JSON body for the error provided.
+func errorResponse(err error) (int, map[string]string) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Status: http.StatusBadRequest, Code: CodeError, Message: err.Error()}
+	}
+
+	return e.Status, map[string]string{"error": e.Message, "code": e.Code}
+}
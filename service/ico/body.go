@@ -0,0 +1,85 @@
+package ico
+
+import (
+	// Standard library
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	// Internal packages
+	"github.com/deuill/mash/service"
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// The default maximum size for images supplied in request bodies, in bytes.
+const defaultMaxBody = 16 << 20
+
+// ProcessBody processes the image supplied in the request body against the pipeline parameters in
+// the request, and writes the processed image back to the user, without fetching any original image
+// from S3. The image type is taken from the 'Content-Type' request header, if it corresponds to a
+// known image type, and is otherwise determined from the image data. Images that cannot be loaded as
+// the type given in the header are rejected. The processed image is stored in the S3 bucket under the
+// path given in the 'key' query parameter, if any, and is not stored otherwise.
+func (m *Ico) ProcessBody(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+	if err := m.checkLength(p); err != nil {
+		return nil, err
+	}
+
+	// Get source for this request, which is used for fetching any additional images required, and for
+	// storing the processed image, if requested.
+	src, err := m.requestSource(w, r)
+	if err != nil {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeSourceError, "%s", err)
+	}
+
+	params, err := m.Presets.resolve(p.Get("params"))
+	if err != nil {
+		return nil, err
+	}
+
+	var key string
+	if k := r.URL.Query().Get("key"); k != "" {
+		if key, err = cleanPath(k); err != nil {
+			return nil, err
+		}
+	}
+
+	// Set any additional headers configured for image responses, using the path given for storing the
+	// processed image, if any.
+	w = m.headerWriter(w, src, params, key)
+
+	// Read image from request body, up to the maximum size allowed.
+	body := io.Reader(r.Body)
+	if max := int64(*m.MaxBody); max >= 0 {
+		body = io.LimitReader(r.Body, max+1)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "failed to read request body: %s", err)
+	} else if max := int64(*m.MaxBody); max >= 0 && int64(len(data)) > max {
+		return nil, service.NewError(http.StatusRequestEntityTooLarge, service.CodeInvalidParams, "request body is larger than the maximum of %d bytes", max)
+	}
+
+	orig, err := image.NewWithType(data, r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, sourceError(err, "failed to read image from request body")
+	}
+
+	img, err := m.transformImage(r.Context(), src, params, orig, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		if err = src.Put(key, img.Data, img.Type.String()); err != nil {
+			return nil, sourceError(err, "failed to store in source")
+		}
+	}
+
+	// Processed images are only ever returned to the user supplying the original image.
+	w.Header().Set("Cache-Control", "no-store")
+	m.writeResponse(img.Data, img.Type.String(), w, r)
+
+	return nil, nil
+}
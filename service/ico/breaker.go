@@ -0,0 +1,97 @@
+package ico
+
+import (
+	// Standard library
+	"errors"
+	"sync"
+	"time"
+
+	// Third-party packages
+	"github.com/goamz/goamz/s3"
+)
+
+// ErrUnavailable is returned for source operations while the circuit breaker for the source is open.
+var ErrUnavailable = errors.New("source is unavailable after repeated failures")
+
+// A breaker fails operations fast after a number of consecutive operations have failed, for a period
+// of time, after which a single operation is allowed to run as a probe. The breaker closes again once
+// an operation succeeds. A nil breaker, or a breaker with no threshold set, never fails operations.
+type breaker struct {
+	// Returns the number of consecutive failures after which the breaker opens, and the duration for
+	// which the breaker stays open before probing.
+	settings func() (threshold int, cooldown time.Duration)
+
+	failures int       // The number of consecutive failed operations.
+	opened   time.Time // The time the breaker was last opened, or the zero time if closed.
+	probing  bool      // Whether a probe operation is running while the breaker is open.
+
+	sync.Mutex // Used for controlling concurrent access to breaker state.
+}
+
+// Returns a breaker opening after the number of consecutive failures returned by the function given,
+// and staying open for the cooldown returned. Both values are read on every operation, and thus may be
+// reloaded.
+func newBreaker(settings func() (threshold int, cooldown time.Duration)) *breaker {
+	return &breaker{settings: settings}
+}
+
+// Checks whether the operation is allowed to run, returning ErrUnavailable if the breaker is open.
+// Calls returning no error must be paired with calls to done.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+
+	threshold, cooldown := b.settings()
+
+	b.Lock()
+	defer b.Unlock()
+
+	if threshold <= 0 || b.opened.IsZero() {
+		return nil
+	} else if b.probing || time.Since(b.opened) < cooldown {
+		return ErrUnavailable
+	}
+
+	b.probing = true
+	return nil
+}
+
+// Records the result of an operation allowed to run, opening the breaker if the number of consecutive
+// failures reaches the threshold, or if a probe operation failed, and closing the breaker otherwise.
+// Errors returned by S3 for invalid requests, such as for missing files, are not failures.
+func (b *breaker) done(err error) {
+	if b == nil {
+		return
+	}
+
+	threshold, _ := b.settings()
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+	if e, ok := err.(*s3.Error); err == nil || (ok && e.StatusCode < 500) {
+		b.failures, b.opened = 0, time.Time{}
+		return
+	}
+
+	b.failures++
+	if threshold > 0 && (b.failures >= threshold || !b.opened.IsZero()) {
+		b.opened = time.Now()
+	}
+}
+
+// Returns true if the breaker is currently open.
+func (b *breaker) open() bool {
+	if b == nil {
+		return false
+	}
+
+	threshold, _ := b.settings()
+
+	b.Lock()
+	defer b.Unlock()
+
+	return threshold > 0 && !b.opened.IsZero()
+}
@@ -0,0 +1,45 @@
+package ico
+
+import (
+	// Standard library
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	// Internal packages
+	"github.com/deuill/mash/service"
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// The default maximum size for images returned as data URIs, in bytes.
+const defaultDataURIMax = 32 << 10
+
+// Returns true if the request given asks for images to be returned as data URIs, via the 'datauri'
+// query parameter.
+func wantsDataURI(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("datauri"))
+	return v
+}
+
+// Returns a response containing the image given as a base64-encoded data URI, along with its type and
+// size, for inlining images in markup. Images larger than the configured maximum size are rejected.
+func (m *Ico) dataURI(img *image.Image) (*service.Response, error) {
+	// Data URIs cannot be compressed, and images compressed with gzip are always decompressed.
+	data := img.Data
+	if image.IsGzip(data) {
+		if d, err := decompress(data); err == nil {
+			data = d
+		}
+	}
+
+	if max := int64(*m.DataURIMax); max >= 0 && int64(len(data)) > max {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "image of %d bytes is larger than the maximum of %d bytes for data URIs", len(data), max)
+	}
+
+	ctype := img.Type.String()
+	return &service.Response{http.StatusOK, map[string]interface{}{
+		"data": "data:" + ctype + ";base64," + base64.StdEncoding.EncodeToString(data),
+		"type": ctype,
+		"size": len(data),
+	}}, nil
+}
@@ -3,17 +3,24 @@ package ico
 import (
 	// Standard library
 	"container/list"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // FileCache implements a simple filesystem-based cache for arbitrary data.
 type FileCache struct {
 	path  string // The path to the directory in which to place cached files.
-	quota int64  // The disk quota size, in bytes. A value of zero means no limit.
+	quota int64  // The disk quota size, in bytes. A negative value means no limit.
 	usage int64  // The current disk usage, in bytes.
+	hits  int64  // The number of successful lookups, updated atomically.
+	miss  int64  // The number of failed lookups, updated atomically.
+	errs  int64  // The number of failed writes.
+	last  string // The error message for the most recent failed write, if any.
 
 	order *list.List               // A doubly-linked list of items, ordered by access time.
 	cache map[string]*list.Element // A reverse lookup table of item names to list elements.
@@ -21,10 +28,22 @@ type FileCache struct {
 	sync.RWMutex // Used for controlling concurrent access to item list and cache table.
 }
 
+// CacheStats represents usage statistics for a cache.
+type CacheStats struct {
+	Usage   int64  `json:"usage"`   // The current disk usage, in bytes.
+	Quota   int64  `json:"quota"`   // The disk quota size, in bytes. A negative value means no limit.
+	Entries int    `json:"entries"` // The number of files stored in cache.
+	Hits    int64  `json:"hits"`    // The number of successful lookups.
+	Misses  int64  `json:"misses"`  // The number of failed lookups.
+	Errors  int64  `json:"errors"`  // The number of failed writes.
+	Error   string `json:"error"`   // The error message for the most recent failed write, if any.
+}
+
 // A file represents all information required for operating on a file in the context of the cache.
 type file struct {
-	size int64
-	key  string
+	size   int64
+	key    string
+	access time.Time // The time the file was last added or accessed.
 }
 
 // A map of initialized caches, indexed under their path names. This is checked against every time
@@ -32,15 +51,23 @@ type file struct {
 var caches map[string]*FileCache
 
 // NewFileCache initializes a file cache under a specific path, most commonly a temporary directory,
-// with an optional quota on the cache size. If the size of the quota is zero, the limit is assumed
-// to be infinite.
+// with a quota on the cache size. If the size of the quota is negative, the size is unlimited. A
+// quota of zero is rejected, as it would not allow for any files to be cached. An error is returned
+// if files cannot be written to the cache directory.
 func NewFileCache(name string, quota int64) (*FileCache, error) {
+	if quota == 0 {
+		return nil, fmt.Errorf("cache quota for '%s' is zero, which does not allow for caching any files", name)
+	}
+
 	// Check if a cache already exists for this path and return it, if any exists.
 	if f, exists := caches[name]; exists {
-		// Update quota size for cache, if the new quota size is greater than the existing one.
-		if quota == 0 || f.quota > 0 && f.quota < quota {
+		// Update quota size for cache, if the new quota size is greater than the existing one. An
+		// unlimited quota is greater than any limited quota.
+		f.Lock()
+		if f.quota > 0 && (quota < 0 || quota > f.quota) {
 			f.quota = quota
 		}
+		f.Unlock()
 
 		return f, nil
 	}
@@ -50,8 +77,9 @@ func NewFileCache(name string, quota int64) (*FileCache, error) {
 		return nil, err
 	}
 
-	// Create directory structure for cached files.
-	if err := os.MkdirAll(name, 0755); err != nil {
+	// Create directory structure for cached files, and check that files can be written to it, as
+	// failing to write files later on would otherwise have every lookup result in a cache miss.
+	if err := checkWritable(name); err != nil {
 		return nil, err
 	}
 
@@ -65,6 +93,22 @@ func NewFileCache(name string, quota int64) (*FileCache, error) {
 	return caches[name], nil
 }
 
+// Creates the directory given, if it does not exist, and returns an error if files cannot be written
+// to the directory.
+func checkWritable(name string) error {
+	if err := os.MkdirAll(name, 0755); err != nil {
+		return err
+	}
+
+	probe := path.Join(name, ".probe")
+	if err := ioutil.WriteFile(probe, nil, 0644); err != nil {
+		return fmt.Errorf("cache directory '%s' is not writable: %s", name, err)
+	}
+
+	os.Remove(probe)
+	return nil
+}
+
 // Add inserts in `value` to file pointed to by `key`. Variable `value` is assumed to be a `[]byte`
 // type, but is passed as an `interface{}` type to satisfy the generic `Cacher` interface.
 func (f *FileCache) Add(key string, value interface{}) {
@@ -77,47 +121,88 @@ func (f *FileCache) Add(key string, value interface{}) {
 		return
 	}
 
+	f.Lock()
+	defer f.Unlock()
+
 	// Do not store data whose size is equal to or larger than the quota size.
-	if f.quota > 0 && int64(len(data)) >= f.quota {
+	if f.quota >= 0 && int64(len(data)) >= f.quota {
 		return
 	}
 
-	f.Lock()
-	defer f.Unlock()
-
 	// If entry already exists, move to front and return.
 	if el, ok = f.cache[key]; ok {
+		el.Value.(*file).access = time.Now()
 		f.order.MoveToFront(el)
 		return
 	}
 
 	// If writing the file would bring us above quota, remove oldest files as required.
 	// NOTE: If the call to write the data below fails, affected files will STILL be removed.
-	for f.quota > 0 && int64(len(data)) > f.quota {
+	for f.quota >= 0 && f.usage+int64(len(data)) > f.quota && f.order.Len() > 0 {
 		f.RemoveOldest()
 	}
 
 	// Create path heirarchy for file.
 	p := path.Join(f.path, key)
 	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		f.errs, f.last = f.errs+1, err.Error()
 		return
 	}
 
 	// Write file to disk.
 	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		f.errs, f.last = f.errs+1, err.Error()
 		return
 	}
 
 	// Push file pointer to front of file list.
 	el = f.order.PushFront(&file{
-		size: int64(len(data)),
-		key:  key,
+		size:   int64(len(data)),
+		key:    key,
+		access: time.Now(),
 	})
 
 	f.usage += el.Value.(*file).size
 	f.cache[key] = el
 }
 
+// SetQuota updates the disk quota for the cache, removing the oldest files as required for the
+// current usage to fit within the new quota. A negative quota means no limit, and a quota of zero is
+// rejected, as with NewFileCache.
+func (f *FileCache) SetQuota(quota int64) error {
+	if quota == 0 {
+		return fmt.Errorf("cache quota for '%s' is zero, which does not allow for caching any files", f.path)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.quota = quota
+	for f.quota >= 0 && f.usage > f.quota && f.order.Len() > 0 {
+		f.RemoveOldest()
+	}
+
+	return nil
+}
+
+// Sweep removes files not accessed within the duration given, as well as the oldest files as required
+// for the current usage to fit within the percentage of the quota given. A zero duration or percentage
+// skips the respective check, and the percentage is ignored for caches without a quota.
+func (f *FileCache) Sweep(ttl time.Duration, watermark int64) {
+	f.Lock()
+	defer f.Unlock()
+
+	for el := f.order.Back(); el != nil; el = f.order.Back() {
+		expired := ttl > 0 && time.Since(el.Value.(*file).access) > ttl
+		over := watermark > 0 && f.quota >= 0 && f.usage > f.quota*watermark/100
+		if !expired && !over {
+			break
+		}
+
+		f.removeElement(el)
+	}
+}
+
 // Get returns data stored under `key`, or `nil` if no data exists.
 func (f *FileCache) Get(key string) interface{} {
 	var data []byte
@@ -128,6 +213,7 @@ func (f *FileCache) Get(key string) interface{} {
 	// Check reverse lookup table for file entry.
 	if el, _ = f.cache[key]; el == nil {
 		f.RUnlock()
+		atomic.AddInt64(&f.miss, 1)
 		return nil
 	}
 
@@ -135,12 +221,16 @@ func (f *FileCache) Get(key string) interface{} {
 
 	// Read file from disk and move file list entry to the front.
 	if data, _ = ioutil.ReadFile(path.Join(f.path, key)); data == nil {
+		atomic.AddInt64(&f.miss, 1)
 		return nil
 	}
 
+	atomic.AddInt64(&f.hits, 1)
+
 	// Move element to the front of the list asynchronously.
 	go func() {
 		f.Lock()
+		el.Value.(*file).access = time.Now()
 		f.order.MoveToFront(el)
 		f.Unlock()
 	}()
@@ -148,8 +238,27 @@ func (f *FileCache) Get(key string) interface{} {
 	return data
 }
 
+// Stats returns usage statistics for the cache.
+func (f *FileCache) Stats() CacheStats {
+	f.RLock()
+	defer f.RUnlock()
+
+	return CacheStats{
+		Usage:   f.usage,
+		Quota:   f.quota,
+		Entries: f.order.Len(),
+		Hits:    atomic.LoadInt64(&f.hits),
+		Misses:  atomic.LoadInt64(&f.miss),
+		Errors:  f.errs,
+		Error:   f.last,
+	}
+}
+
 // Remove removes file stored under `key`.
 func (f *FileCache) Remove(key string) {
+	f.Lock()
+	defer f.Unlock()
+
 	if el, exists := f.cache[key]; exists {
 		f.removeElement(el)
 	}
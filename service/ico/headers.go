@@ -0,0 +1,125 @@
+package ico
+
+import (
+	// Standard library
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers represents additional headers set for image responses, with values given as templates,
+// which may reference the '{path}', '{params}', '{region}' and '{bucket}' variables for the request.
+// Headers can be set from configuration as a '|'-separated list, e.g. 'Timing-Allow-Origin: *|
+// Cache-Tag: {bucket}{path}'. Headers already set for the response are kept, unless the header name
+// is prefixed with '!', in which case the header is replaced.
+type Headers []headerTemplate
+
+// A headerTemplate represents a single header set for image responses.
+type headerTemplate struct {
+	name    string // The canonical header name.
+	value   string // The header value, which may contain template variables.
+	replace bool   // Whether the header replaces any header of the same name already set.
+}
+
+// Set parses header templates from the value provided, and is used for setting header templates from
+// configuration.
+func (h *Headers) Set(value string) error {
+	var result Headers
+	for _, f := range strings.Split(value, "|") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		v := strings.SplitN(f, ":", 2)
+		if len(v) < 2 {
+			return fmt.Errorf("unable to parse malformed header '%s'", f)
+		}
+
+		name := strings.TrimSpace(v[0])
+		replace := strings.HasPrefix(name, "!")
+		if name = strings.TrimPrefix(name, "!"); name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("header name '%s' is not valid", name)
+		}
+
+		result = append(result, headerTemplate{http.CanonicalHeaderKey(name), strings.TrimSpace(v[1]), replace})
+	}
+
+	*h = result
+	return nil
+}
+
+// String returns the header templates as a '|'-separated list.
+func (h *Headers) String() string {
+	var list []string
+	for _, t := range *h {
+		name := t.name
+		if t.replace {
+			name = "!" + name
+		}
+
+		list = append(list, name+": "+t.value)
+	}
+
+	return strings.Join(list, "|")
+}
+
+// A headerWriter sets templated headers on the response immediately before the response is written,
+// so that headers set by handlers are known.
+type headerWriter struct {
+	http.ResponseWriter
+
+	headers Headers           // The header templates to set.
+	vars    *strings.Replacer // The replacer for template variables.
+	done    bool              // Whether headers have been set.
+}
+
+// Returns a response writer setting the configured header templates for the request, along with the
+// 'Surrogate-Key' header, if configured, with template variables replaced by the values given. The
+// response writer given is returned as-is if no header templates are configured.
+func (m *Ico) headerWriter(w http.ResponseWriter, src *Source, params, imgPath string) http.ResponseWriter {
+	headers := append(Headers{}, *m.Headers...)
+	if *m.Surrogate != "" {
+		headers = append(headers, headerTemplate{"Surrogate-Key", *m.Surrogate, false})
+	}
+
+	if len(headers) == 0 {
+		return w
+	}
+
+	return &headerWriter{
+		ResponseWriter: w,
+		headers:        headers,
+		vars: strings.NewReplacer(
+			"{path}", imgPath,
+			"{params}", params,
+			"{region}", src.bucket.Region.Name,
+			"{bucket}", src.bucket.Name,
+		),
+	}
+}
+
+// WriteHeader sets templated headers, and writes the response header with the status code given.
+func (w *headerWriter) WriteHeader(code int) {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write sets templated headers, if not already set, and writes the data given as part of the response.
+func (w *headerWriter) Write(data []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(data)
+}
+
+// Sets templated headers on the response, once. Headers already set are kept, unless replaced.
+func (w *headerWriter) setHeaders() {
+	if w.done {
+		return
+	}
+
+	w.done = true
+	for _, t := range w.headers {
+		if t.replace || w.Header().Get(t.name) == "" {
+			w.Header().Set(t.name, w.vars.Replace(t.value))
+		}
+	}
+}
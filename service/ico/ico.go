@@ -2,101 +2,422 @@ package ico
 
 import (
 	// Standard library
+	"bytes"
+	"compress/gzip"
+	"context"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	// Internal packages
 	"github.com/deuill/mash/service"
+	"github.com/deuill/mash/service/ico/image"
 	"github.com/deuill/mash/service/ico/pipeline"
 )
 
-// The Ico service, containing state shared between methods.
+// The Ico service, containing configuration and state shared between methods. Configuration values
+// are never changed once parsed, and reloading configuration replaces the service in use with a new
+// service sharing the same state.
 type Ico struct {
-	Quota       *int64  // The image cache size maximum, in bytes.
-	S3Region    *string // S3 region to use for bucket.
-	S3Bucket    *string // S3 bucket to use for image access.
-	S3AccessKey *string // Access key to use for bucket. If empty, access will be attempted with IAM.
-	S3SecretKey *string // Secret key to use for bucket. If empty, access will be attempted with IAM.
+	Quota       *service.Size  // The image cache size maximum, in bytes. May be unlimited.
+	LocalCache  *bool          // Whether images are cached on local disk, in addition to S3.
+	S3Region    *string        // S3 region to use for bucket.
+	S3Bucket    *string        // S3 bucket to use for image access.
+	S3AccessKey *string        // Access key to use for bucket. If empty, access will be attempted with IAM.
+	S3SecretKey *string        // Secret key to use for bucket. If empty, access will be attempted with IAM.
+	S3Limit     *int           // The maximum number of concurrent S3 operations. Zero means no limit.
+	ProcLimit   *int           // The maximum number of images processed concurrently. Zero means no limit.
+	SourceLimit *SourceOptions // The maximum number of images processed concurrently for sources, if limited.
+	S3Breaker   *int           // The number of consecutive failed S3 operations after which operations fail fast.
+	S3Cooldown  *time.Duration // The duration for which S3 operations fail fast before being retried.
+	RegionHdr   *string        // Request header containing the S3 region for the request, if any.
+	BucketHdr   *string        // Request header containing the S3 bucket for the request, if any.
+	FontDir     *string        // Directory containing font files available for rendering text.
+	MaxFrames   *int64         // The maximum number of frames allowed in images. Zero means no limit.
+	MaxDim      *int64         // The maximum width and height requested for images. Zero means no limit.
+	MaxDimError *bool          // Whether requests exceeding the maximum dimension fail, rather than being clamped.
+	Defaults    *string        // Default pipeline parameters, applied unless overridden by the request.
+	Presets     *Presets       // Pipeline parameters for named presets, referenced by requests.
+	Gravity     *SourceOptions // Default crop gravities for sources, applied unless set by the request.
+	Missing     *SourceOptions // Images served for sources in place of missing images, if any.
+	StripPrefix *SourceOptions // Path prefixes removed from image paths for sources, if any.
+	AddPrefix   *SourceOptions // Path prefixes added to image paths for sources, if any.
+	Formats     *SourceOptions // Output formats allowed for sources, if limited.
+	Sizes       *SourceOptions // Combinations of width and height allowed for sources, if limited.
+	Negotiate   *FormatList    // Output formats negotiated for requests without a format, in order of preference.
+	SizeSnap    *bool          // Whether sizes not allowed are snapped to the nearest size allowed.
+	Samples     *int64         // The number of processing latencies kept for computing percentiles.
+	MissingCode *int           // The HTTP status code for responses serving images in place of missing images.
+	Timeout     *time.Duration // The maximum duration for processing images. Zero means no limit.
+	Fallback    *bool          // Whether the original image is returned for images failing to process.
+	Debug       *bool          // Whether the steps applied while processing may be requested.
+	DataURIMax  *service.Size  // The maximum size for images returned as data URIs.
+	MaxBody     *service.Size  // The maximum size for images supplied in request bodies.
+	MaxParams   *int           // The maximum length for pipeline parameters in request paths.
+	MaxPath     *int           // The maximum length for image paths in request paths.
+	MaxVariants *int           // The maximum number of variants processed per request. Zero means no limit.
+	Headers     *Headers       // Additional headers set for image responses.
+	Surrogate   *string        // The template for surrogate keys set for image responses, if any.
+	ContentKeys *bool          // Whether paths for processed images contain a digest of the original image.
+	Jitter      *int64         // The maximum percentage by which cache ages are reduced for responses.
+	TokenKey    *string        // The key signed tokens are verified against. If empty, tokens are disabled.
+	TokenOnly   *bool          // Whether images may only be requested via signed tokens.
 
-	sources map[string]*Source // A map of sources, indexed under their region and bucket name.
+	MemoryLimit    *service.Size  // The heap size above which cached VIPS operations are dropped.
+	MemoryInterval *time.Duration // The interval between checks of heap size against the limit.
+	MemoryGC       *bool          // Whether garbage collection is forced when exceeding the limit.
+
+	SweepInterval  *time.Duration // The interval between sweeps of local caches. Zero disables sweeping.
+	SweepTTL       *time.Duration // The duration after which files not accessed are swept. Zero means no limit.
+	SweepWatermark *int64         // The percentage of the quota local caches are swept down to. Zero means no limit.
+
+	Quality *pipeline.Qualities // Default qualities for output formats, applied unless set by the request.
+
+	limit *limiter // The limiter for S3 operations, shared between all sources.
+	proc  *limiter // The limiter for processing images, shared between all sources.
+
+	*state
+}
+
+// State shared between all configurations of the Ico service, which is kept when reloading configuration.
+type state struct {
+	current  atomic.Value       // The Ico service for the configuration currently in use.
+	sources  map[string]*Source // A map of sources, indexed under their region and bucket name.
+	srcLock  sync.RWMutex       // Used for controlling concurrent access to the map of sources.
+	warm     *WarmJob           // The most recent list of images submitted for processing ahead of time.
+	warmLock sync.Mutex         // Used for controlling concurrent access to the warm job.
+	fallback int64              // The number of requests served the original image, updated atomically.
+	pending  sync.Map           // Images being processed in the background for placeholder requests.
+	latency  *sampler           // The most recent latencies for processing images.
 }
 
-// Process request for image transformation, taking care caching both to local disk and S3.
+// The directory local caches are placed under, relative to the temporary directory.
+const cacheDir = "mash/ico"
+
+// The default maximum lengths for pipeline parameters and image paths in request paths.
+const (
+	defaultMaxParams = 1024
+	defaultMaxPath   = 2048
+)
+
+// Process request for image transformation, taking care caching both to local disk and S3. Requests
+// are rejected if only signed tokens are accepted, as handled by ProcessToken.
 func (m *Ico) Process(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+	if err := m.checkLength(p); err != nil {
+		return nil, err
+	} else if *m.TokenOnly {
+		return nil, service.NewError(http.StatusForbidden, service.CodeForbidden, "images may only be requested via signed tokens")
+	}
+
+	return m.process(w, r, p)
+}
+
+// Processes the image pointed to by the parameters given, as described for Process.
+func (m *Ico) process(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
 	// Get source for this request, pulling the region and bucket names from request headers.
-	src, err := m.getSource(r.Header.Get("X-S3-Region"), r.Header.Get("X-S3-Bucket"))
+	src, err := m.requestSource(w, r)
+	if err != nil {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeSourceError, "%s", err)
+	}
+
+	// Split any additional stages from the image path, which are processed in order, each from the
+	// result of the previous stage.
+	stageParams, name := splitStages(p.Get("image"))
+	origPath, err := m.sourcePath(src, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve any preset referenced in the request, so that processed images are cached under the
+	// parameters resolved for the preset. Requests with multiple stages have the final stage processed
+	// from the result of the stage before it, in place of the original image.
+	stages, params, imgPath, err := m.resolveStages(src, append([]string{p.Get("params")}, stageParams...), origPath)
 	if err != nil {
 		return nil, err
 	}
 
-	params, imgPath := p.Get("params"), p.Get("image")
-	if imgPath == "" {
-		return nil, fmt.Errorf("image URL is unset or empty")
+	// Negotiate output format for requests not setting one, so that processed images are cached under
+	// the format negotiated.
+	params = m.negotiateFormat(w, r, src, params)
+
+	procPath, err := m.cachePath(src, params, imgPath)
+	if err != nil {
+		return nil, err
 	}
 
-	dir, file := path.Split(imgPath)
-	procPath := path.Join(dir, params, file)
+	// Set any additional headers configured for image responses.
+	w = m.headerWriter(w, src, params, origPath)
 
-	// Fetch existing processed file, if any.
-	if img, _ := src.Get(procPath); img != nil {
-		writeResponse(img.Data, img.Size, img.Type.String(), w)
+	// Return placeholder for image immediately, if requested, processing the image in the background.
+	// Any intermediate stages are processed beforehand, as placeholders are created from their result.
+	// Placeholders traced as SVG images are returned in place of blurred images, if requested.
+	mode := r.URL.Query().Get("placeholder")
+	if placeholder, _ := strconv.ParseBool(mode); placeholder || mode == "svg" {
+		if err = m.processStages(r.Context(), src, stages); err != nil {
+			return nil, err
+		}
+
+		return m.placeholder(w, r, src, params, imgPath, procPath, mode == "svg")
+	}
+
+	// Perceptual hashes and colors for processed images, and the steps applied while processing images,
+	// are returned in response headers, if requested. Steps are only returned if debugging is enabled.
+	opts := &transformOptions{color: r.URL.Query().Get("color")}
+	opts.hash, _ = strconv.ParseBool(r.URL.Query().Get("hash"))
+	if opts.color != "" && opts.color != pipeline.ColorAverage && opts.color != pipeline.ColorDominant {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "unknown method '%s' for computing color", opts.color)
+	}
+	if *m.Debug {
+		opts.debug, _ = strconv.ParseBool(r.URL.Query().Get("debug"))
+	}
+
+	// Fetch existing processed file, if any, unless a refresh of the processed file is requested, in
+	// which case the processed file is removed from the local cache and replaced once processed.
+	// Images are always processed anew when debugging, as steps are only known while processing.
+	if refresh, _ := strconv.ParseBool(r.URL.Query().Get("refresh")); refresh {
+		if cache, _ := src.localCache(); cache != nil {
+			cache.Remove(procPath)
+		}
+	} else if opts.debug {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else if img, _ := src.Get(procPath); img != nil {
+		if opts.hash {
+			if err = writeHash(w, img); err != nil {
+				return nil, err
+			}
+		}
+
+		if opts.color != "" {
+			if err = writeColor(w, img, opts.color); err != nil {
+				return nil, err
+			}
+		}
+
+		writeFormat(w, params, img)
+		if wantsDataURI(r) {
+			return m.dataURI(img)
+		}
+
+		m.writeResponse(img.Data, img.Type.String(), w, r)
 		return nil, nil
 	}
 
-	// Prepare pipeline and set parameters from user request.
-	pl, err := pipeline.New(params)
+	// Process original image against pipeline parameters from user request, falling back to the
+	// original image if processing fails and fallback is enabled. Original images served as fallback
+	// are not cached, and processing will be attempted again for subsequent requests.
+	var img *image.Image
+	start := time.Now()
+
+	m.refreshOriginal(src, origPath)
+	if err = m.processStages(r.Context(), src, stages); err == nil {
+		img, err = m.transform(r.Context(), src, params, imgPath, opts)
+	}
+
+	if err == nil {
+		m.latency.record(time.Since(start), *m.Samples)
+	}
+
+	// Steps applied are returned even if processing fails, as they may help in diagnosing failures.
+	for _, step := range opts.steps {
+		w.Header().Add("X-Ico-Step", fmt.Sprintf("%s %dx%d", step.Name, step.Width, step.Height))
+	}
+
+	// Serve image configured for missing images in place of missing original images, if any. Images
+	// served in this way are processed against the pipeline parameters from the user request, and are
+	// cached as with any other image, but responses are not, as the original image may be added later.
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize pipeline: %s", err)
+		if missing, merr := m.missingImage(r.Context(), src, params, err); merr == nil {
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Ico-Missing", "true")
+			m.writeStatusResponse(*m.MissingCode, missing.Data, missing.Type.String(), w, r)
+
+			return nil, nil
+		}
+		orig, err := m.fallbackImage(src, imgPath, err)
+		if err != nil {
+			return nil, err
+		}
+
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Ico-Fallback", "true")
+		m.writeResponse(orig.Data, orig.Type.String(), w, r)
+
+		return nil, nil
+	}
+
+	if opts.hash {
+		if err = writeHash(w, img); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.color != "" {
+		if err = writeColor(w, img, opts.color); err != nil {
+			return nil, err
+		}
 	}
 
+	writeFormat(w, params, img)
+	writeReduction(w, params, opts.size, img)
+
+	// Store image locally and upload to S3 bucket asynchronously, then write image back to user, either
+	// as-is or as a data URI, if requested. Responses to HEAD requests are written the same way, but
+	// without a body.
+	go src.Put(procPath, img.Data, img.Type.String())
+	if wantsDataURI(r) {
+		return m.dataURI(img)
+	}
+
+	m.writeResponse(img.Data, img.Type.String(), w, r)
+	return nil, nil
+}
+
+// Options for processing images, as requested by the user, along with any results of processing
+// other than the processed image itself.
+type transformOptions struct {
+	hash  bool            // Whether the perceptual hash is computed while processing.
+	color string          // The method the color is computed with while processing, if any.
+	debug bool            // Whether the steps applied while processing are recorded.
+	steps []pipeline.Step // The steps applied while processing, if recorded.
+	size  int64           // The size of the original image processed, in bytes.
+}
+
+// Fetches the original image from source and processes it through a pipeline initialized with the
+// parameters given. Processing is stopped if the context is cancelled or processing takes too long.
+// Options given are applied while processing, and may be nil.
+func (m *Ico) transform(ctx context.Context, src *Source, params, imgPath string, opts *transformOptions) (*image.Image, error) {
 	// Fetch original image from remote server or local cache.
 	img, err := src.Get(imgPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch from source: %s", err)
+		return nil, sourceError(err, "failed to fetch from source")
 	}
 
-	// Process image through pipeline.
-	if err = pl.Process(img); err != nil {
-		return nil, fmt.Errorf("failed to process image: %s", err)
+	return m.transformImage(ctx, src, params, img, nil, opts)
+}
+
+// Processes the original image given through a pipeline initialized with the parameters given. The
+// original image is left unchanged, and a new image is returned containing the processed result. If
+// a decoded image is given, it is processed in place of the original image data.
+func (m *Ico) transformImage(ctx context.Context, src *Source, params string, orig *image.Image, dec *pipeline.Decoded, opts *transformOptions) (*image.Image, error) {
+	// Prepare pipeline and set parameters from user request, applying the default crop gravity for the
+	// source, if any.
+	gravity := m.Gravity.get(src)
+	pl, err := pipeline.NewWithDefaults(cropGravity(params, gravity), cropGravity(*m.Defaults, gravity))
+	if err != nil {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "failed to initialize pipeline: %s", err)
 	}
 
-	// If processing a GET request, store image locally and upload to S3 bucket asynchronously, then
-	// write image back to user. Otherwise, wait for upload process to complete and return nothing.
-	switch r.Method {
-	case "GET":
-		go src.Put(procPath, img.Data, img.Type.String())
-		writeResponse(img.Data, img.Size, img.Type.String(), w)
-	default:
-		src.Put(procPath, img.Data, img.Type.String())
-		return &service.Response{http.StatusOK, map[string]bool{"result": true}}, nil
+	// Copy image representation, as the pipeline replaces image data in-place.
+	img := &image.Image{Data: orig.Data, Size: orig.Size, Type: orig.Type}
+
+	// Process image through pipeline, fetching any additional images from the same source.
+	if *m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *m.Timeout)
+		defer cancel()
 	}
 
-	return nil, nil
+	pl.Fetch, pl.MaxFrames = src.Get, *m.MaxFrames
+	pl.MaxDimension, pl.MaxDimensionError = *m.MaxDim, *m.MaxDimError
+	if formats := m.Formats.get(src); formats != "" {
+		pl.Formats = strings.Split(formats, "|")
+	}
+
+	if sizes := m.Sizes.get(src); sizes != "" {
+		pl.Dimensions, _ = parseSizes(sizes)
+		pl.DimensionSnap = *m.SizeSnap
+	}
+
+	if opts != nil {
+		pl.Hash, pl.Color, pl.Debug = opts.hash, opts.color, opts.debug
+	}
+
+	// Wait for a processing slot for the source, if limited, before waiting for a slot shared between
+	// all sources, so that requests waiting for a busy source do not hold slots needed by others.
+	proc := src.procLimit()
+	proc.acquire()
+	m.proc.acquire()
+	if dec != nil {
+		err = pl.ProcessDecoded(ctx, dec, img)
+	} else {
+		err = pl.ProcessContext(ctx, img)
+	}
+	m.proc.release()
+	proc.release()
+
+	if opts != nil {
+		opts.steps, opts.size = pl.Steps, orig.Size
+	}
+
+	if err != nil {
+		if _, ok := err.(*pipeline.LimitError); ok {
+			return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "failed to process image: %s", err)
+		} else if _, ok := err.(*pipeline.DecodeError); ok {
+			return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidImage, "failed to process image: %s", err)
+		} else if _, ok := err.(*pipeline.UnsupportedError); ok {
+			return nil, service.NewError(http.StatusUnsupportedMediaType, service.CodeUnsupported, "failed to process image: %s", err)
+		} else if err == context.DeadlineExceeded {
+			return nil, service.NewError(http.StatusGatewayTimeout, service.CodeTimeout, "failed to process image: %s", err)
+		}
+
+		return nil, service.NewError(http.StatusInternalServerError, service.CodeProcessError, "failed to process image: %s", err)
+	}
+
+	return img, nil
 }
 
 // Purge removes the original image pointed to by the request, along with any processed child images
 // in the local cache and the remote server.
 func (m *Ico) Purge(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+	if err := m.checkLength(p); err != nil {
+		return nil, err
+	}
+
 	// Get source for this request, pulling the region and bucket names from request headers.
-	src, err := m.getSource(r.Header.Get("X-S3-Region"), r.Header.Get("X-S3-Bucket"))
+	src, err := m.requestSource(w, r)
 	if err != nil {
-		return nil, err
+		return nil, service.NewError(http.StatusBadRequest, service.CodeSourceError, "%s", err)
 	}
 
 	// Get image URL from request.
-	imgPath := p.Get("image")
-	if imgPath == "" {
-		return nil, fmt.Errorf("image URL is unset or empty")
+	imgPath, err := m.sourcePath(src, p.Get("image"))
+	if err != nil {
+		return nil, err
 	}
 
 	imgDir, imgName := path.Split(imgPath)
 
-	// Fetch list of directories in image path and append image name to each directory.
+	// Fetch list of directories in image path and append image name to each directory. Directories
+	// named after pipeline parameters are listed in turn, as they may contain images processed in
+	// multiple stages.
 	dirList, err := src.ListDirs(imgDir)
 	if err != nil {
-		return nil, err
+		return nil, sourceError(err, "failed to list directories")
+	}
+
+	for i := 0; i < len(dirList); i++ {
+		if !strings.Contains(path.Base(dirList[i]), "=") {
+			continue
+		}
+
+		dirs, err := src.ListDirs(dirList[i])
+		if err != nil {
+			return nil, sourceError(err, "failed to list directories")
+		}
+
+		dirList = append(dirList, dirs...)
 	}
 
 	dirList = append(dirList, imgDir)
@@ -106,12 +427,154 @@ func (m *Ico) Purge(w http.ResponseWriter, r *http.Request, p service.Params) (*
 
 	// Delete images from local and remote cache.
 	if err = src.Delete(dirList...); err != nil {
-		return nil, err
+		return nil, sourceError(err, "failed to delete from source")
 	}
 
 	return &service.Response{http.StatusOK, map[string]bool{"result": true}}, nil
 }
 
+// Stats returns usage statistics for the local cache of each source initialized, indexed under
+// the source region and bucket name.
+func (m *Ico) Stats(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+	m.srcLock.RLock()
+	defer m.srcLock.RUnlock()
+
+	stats := make(map[string]CacheStats)
+	for key, src := range m.sources {
+		if cache, err := src.localCache(); cache != nil {
+			stats[key] = cache.Stats()
+		} else if err != nil {
+			stats[key] = CacheStats{Error: err.Error()}
+		}
+	}
+
+	return &service.Response{http.StatusOK, stats}, nil
+}
+
+// Returns the image path given in normalized form, or an error if the path is empty or contains any
+// '..' elements, which could otherwise be used for escaping the local cache directory. Backslashes are
+// also taken as separators, and paths are also checked with any percent-encoding removed, as either
+// may be turned into '..' elements further along, e.g. by S3 or by proxies in front of Mash.
+func cleanPath(name string) (string, error) {
+	if strings.Trim(name, "/") == "" {
+		return "", service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "image URL is unset or empty")
+	}
+
+	check := []string{name}
+	if unescaped, err := url.PathUnescape(name); err == nil && unescaped != name {
+		check = append(check, unescaped)
+	}
+
+	for _, p := range check {
+		for _, elem := range strings.FieldsFunc(p, isPathSeparator) {
+			if elem == ".." {
+				return "", service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "image URL '%s' contains invalid path elements", name)
+			}
+		}
+	}
+
+	return path.Clean("/" + name), nil
+}
+
+// Returns true for characters taken as path separators when checking paths for '..' elements.
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// Returns the path under which the image pointed to by the path given is stored for the source given,
+// in normalized form. Any prefix configured for removal is removed from paths starting with it, and
+// any prefix configured for addition is then added, so that paths used in requests need not match the
+// layout of the S3 bucket.
+func (m *Ico) sourcePath(src *Source, name string) (string, error) {
+	name, err := cleanPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	if prefix := m.StripPrefix.get(src); prefix != "" {
+		prefix = path.Clean("/" + prefix)
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			name = strings.TrimPrefix(name, prefix)
+		}
+	}
+
+	if prefix := m.AddPrefix.get(src); prefix != "" {
+		name = path.Join(prefix, name)
+	}
+
+	return cleanPath(name)
+}
+
+// Returns the path under which the image pointed to by the path given is stored after processing
+// against the pipeline parameters given. Image paths are expected to have been passed through
+// cleanPath beforehand.
+func processedPath(params, name string) (string, error) {
+	if params == "" || params == "." || params == ".." {
+		return "", service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "pipeline parameters are unset or invalid")
+	}
+
+	dir, file := path.Split(name)
+	return path.Join(dir, params, file), nil
+}
+
+// Returns the path under which the image pointed to by the path given is stored for the source given
+// after processing against the pipeline parameters given. If content keys are enabled, the directory
+// named after the pipeline parameters is suffixed with a digest of the entity tag for the original
+// image, e.g. 'width=200@9f2c61a3b0d4e857', so that images are processed anew under different paths
+// whenever original images are replaced, which requires checking the original image for every call.
+func (m *Ico) cachePath(src *Source, params, imgPath string) (string, error) {
+	procPath, err := processedPath(params, imgPath)
+	if err != nil || !*m.ContentKeys {
+		return procPath, err
+	}
+
+	tag, err := src.ETag(imgPath)
+	if err != nil {
+		return "", sourceError(err, "failed to fetch from source")
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(tag))
+
+	return processedPath(fmt.Sprintf("%s@%016x", params, h.Sum64()), imgPath)
+}
+
+// Removes the original image pointed to by the path given from the local cache of the source given,
+// if content keys are enabled, as images are only processed anew under such paths once the original
+// image has been replaced, and any original image cached locally is then out of date.
+func (m *Ico) refreshOriginal(src *Source, imgPath string) {
+	if !*m.ContentKeys {
+		return
+	}
+
+	if cache, _ := src.localCache(); cache != nil {
+		cache.Remove(imgPath)
+	}
+}
+
+// Gets source for request, pulling the region and bucket names from the configured request headers.
+// Headers used are added to the list of headers the response varies by, as the response depends on
+// them.
+func (m *Ico) requestSource(w http.ResponseWriter, r *http.Request) (*Source, error) {
+	w.Header().Add("Vary", *m.RegionHdr)
+	w.Header().Add("Vary", *m.BucketHdr)
+
+	return m.getSource(r.Header.Get(*m.RegionHdr), r.Header.Get(*m.BucketHdr))
+}
+
+// Returns an error if the pipeline parameters or image path given in the request path exceed their
+// configured maximum length, so that overly long requests are rejected before any further work is
+// done. Lengths of zero or less place no limit.
+func (m *Ico) checkLength(p service.Params) error {
+	if params := p.Get("params"); *m.MaxParams > 0 && len(params) > *m.MaxParams {
+		return service.NewError(http.StatusRequestURITooLong, service.CodeInvalidParams, "pipeline parameters exceed maximum length of %d", *m.MaxParams)
+	} else if name := p.Get("image"); *m.MaxPath > 0 && len(name) > *m.MaxPath {
+		return service.NewError(http.StatusRequestURITooLong, service.CodeInvalidParams, "image path exceeds maximum length of %d", *m.MaxPath)
+	}
+
+	return nil
+}
+
 // Gets source according to region and bucket, and initializes local cache on that source. Passing
 // an empty region and bucket name will have Ico fall back to the configuration defaults, if any.
 func (m *Ico) getSource(region, bucket string) (*Source, error) {
@@ -126,48 +589,508 @@ func (m *Ico) getSource(region, bucket string) (*Source, error) {
 
 	key := region + "/" + bucket
 
-	// Check for existing source, or initialize new source for specified region and bucket.
+	// Check for existing source, or initialize new source for specified region and bucket. Sources are
+	// checked for again once the map is locked for writing, as another request may have initialized the
+	// source in the meantime.
+	m.srcLock.RLock()
 	src, exists := m.sources[key]
-	if !exists {
-		if src, err = NewSource(region, bucket, access, secret); err != nil {
-			return nil, err
+	m.srcLock.RUnlock()
+
+	if exists {
+		return src, nil
+	}
+
+	m.srcLock.Lock()
+	defer m.srcLock.Unlock()
+
+	if src, exists = m.sources[key]; exists {
+		return src, nil
+	}
+
+	if src, err = NewSource(region, bucket, access, secret); err != nil {
+		return nil, err
+	}
+
+	src.limit = func() *limiter { return m.config().limit }
+	src.breaker = newBreaker(func() (int, time.Duration) {
+		conf := m.config()
+		return *conf.S3Breaker, *conf.S3Cooldown
+	})
+
+	// Sources are configured from the configuration currently in use, rather than the configuration
+	// used for the request, as sources initialized while reloading configuration would otherwise keep
+	// settings from the configuration replaced.
+	if err = m.config().configureSource(src); err != nil {
+		return nil, err
+	}
+
+	m.sources[key] = src
+	return src, nil
+}
+
+// Applies configuration values set for sources to the source given, either when initializing the
+// source, or when reloading configuration for sources already initialized.
+func (m *Ico) configureSource(src *Source) error {
+	// Sources without a processing limit of their own share the global processing limiter only.
+	n, _ := strconv.Atoi(m.SourceLimit.get(src))
+	src.setProcLimit(n)
+
+	if !*m.LocalCache {
+		src.DetachCache()
+		return nil
+	} else if cache, _ := src.localCache(); cache != nil {
+		return cache.SetQuota(int64(*m.Quota))
+	}
+
+	// Sources are used without a local cache if the cache cannot be initialized, e.g. if the cache
+	// directory for the source is not writable, rather than have every request for the source fail.
+	if err := src.InitCache(cacheDir, int64(*m.Quota)); err != nil {
+		log.Printf("ico: local cache disabled for source '%s': %s", src.key(), err)
+	}
+
+	return nil
+}
+
+// Returns the sources initialized so far, in no particular order. The map of sources is only locked
+// while copied, so that long-running operations on sources do not block the initialization of others.
+func (m *Ico) sourceList() []*Source {
+	m.srcLock.RLock()
+	defer m.srcLock.RUnlock()
+
+	list := make([]*Source, 0, len(m.sources))
+	for _, src := range m.sources {
+		list = append(list, src)
+	}
+
+	return list
+}
+
+// Returns the Ico service for the configuration currently in use.
+func (m *Ico) config() *Ico {
+	return m.current.Load().(*Ico)
+}
+
+// Returns a handler calling the method given on the Ico service for the configuration currently in
+// use, so that configuration values stay the same for the duration of each request, even if reloaded.
+func (m *Ico) handle(method func(*Ico, http.ResponseWriter, *http.Request, service.Params) (*service.Response, error)) service.HandleFunc {
+	return func(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+		return method(m.config(), w, r, p)
+	}
+}
+
+// Parses configuration values into a new Ico service sharing the same state, and replaces the service
+// currently in use once parsed, so that values in use by requests are never changed. Loaded values are
+// then applied to the pipeline and to any sources already initialized.
+func (m *Ico) reload(parse service.ParseFunc) error {
+	conf, flags := newIco(m.state)
+	parse("ico", flags)
+
+	// Reject a quota of zero when loading configuration, rather than when initializing the local cache
+	// for the first request to each source, so that misconfigured instances fail to start. Values in
+	// use are kept if reloaded configuration is rejected.
+	if *conf.LocalCache && *conf.Quota == 0 {
+		return fmt.Errorf("cache quota of 0 is invalid, set 'quota' to 'unlimited' or disable 'local-cache' instead")
+	}
+
+	// Check that the directory containing local caches is writable, so that misconfigured volumes are
+	// reported once, on startup, rather than for the first request to each source.
+	if *conf.LocalCache {
+		if err := checkWritable(path.Join(os.TempDir(), cacheDir)); err != nil {
+			return err
 		}
+	}
 
-		if err = src.InitCache("mash/ico", *m.Quota); err != nil {
-			return nil, err
+	// Limiters are created before the configuration is put in use, and are replaced only if their
+	// limits have changed.
+	var prev *Ico
+	if v := m.current.Load(); v != nil {
+		prev = v.(*Ico)
+	} else {
+		prev = &Ico{}
+	}
+
+	conf.limit = reuseLimiter(prev.limit, *conf.S3Limit)
+	conf.proc = reuseLimiter(prev.proc, *conf.ProcLimit)
+
+	// Sources are locked while the configuration is replaced, so that sources initialized concurrently
+	// are either configured from the configuration loaded, or are configured again below.
+	m.srcLock.Lock()
+	defer m.srcLock.Unlock()
+
+	m.current.Store(conf)
+	pipeline.SetFontDir(*conf.FontDir)
+	pipeline.SetDefaultQuality(*conf.Quality)
+
+	for _, src := range m.sources {
+		if err := conf.configureSource(src); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// Returns the original image for requests that failed to process, if fallback is enabled and the
+// error given was caused by processing the image. The error given is returned otherwise.
+func (m *Ico) fallbackImage(src *Source, imgPath string, err error) (*image.Image, error) {
+	e, ok := err.(*service.Error)
+	if !*m.Fallback || !ok {
+		return nil, err
+	} else if e.Code != service.CodeProcessError && e.Code != service.CodeInvalidImage && e.Code != service.CodeUnsupported && e.Code != service.CodeTimeout {
+		return nil, err
+	}
+
+	orig, ferr := src.Get(imgPath)
+	if ferr != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&m.fallback, 1)
+	return orig, nil
+}
+
+// Returns the image configured for missing images of the source given, processed against the pipeline
+// parameters given, if the error given was caused by a missing original image. The error given is
+// returned otherwise, or if the image configured cannot be processed.
+func (m *Ico) missingImage(ctx context.Context, src *Source, params string, err error) (*image.Image, error) {
+	e, ok := err.(*service.Error)
+	missing := m.Missing.get(src)
+	if missing == "" || !ok || e.Code != service.CodeNotFound {
+		return nil, err
+	}
+
+	imgPath, perr := cleanPath(missing)
+	if perr != nil {
+		return nil, err
+	}
+
+	procPath, perr := processedPath(params, imgPath)
+	if perr != nil {
+		return nil, err
+	}
+
+	if img, _ := src.Get(procPath); img != nil {
+		return img, nil
+	}
+
+	img, merr := m.transform(ctx, src, params, imgPath, nil)
+	if merr != nil {
+		return nil, err
+	}
+
+	go src.Put(procPath, img.Data, img.Type.String())
+	return img, nil
+}
 
-		m.sources[key] = src
+// Returns a service error for an error returned by a source, prefixed with the message provided.
+// Missing images, empty images, images of unknown type and unavailable sources are reported as such,
+// and all other errors are assumed to be source errors.
+func sourceError(err error, msg string) error {
+	if isNotFound(err) {
+		return service.NewError(http.StatusNotFound, service.CodeNotFound, "%s: %s", msg, err)
+	} else if err == image.ErrEmpty {
+		return service.NewError(http.StatusUnprocessableEntity, service.CodeEmptyImage, "%s: %s", msg, err)
+	} else if err == image.ErrUnknownType || err == image.ErrTypeMismatch {
+		return service.NewError(http.StatusBadRequest, service.CodeInvalidImage, "%s: %s", msg, err)
+	} else if err == ErrUnavailable {
+		return service.NewError(http.StatusServiceUnavailable, service.CodeUnavailable, "%s: %s", msg, err)
 	}
 
-	return m.sources[key], nil
+	return service.NewError(http.StatusBadGateway, service.CodeSourceError, "%s: %s", msg, err)
 }
 
-// Writes image data back to user.
-func writeResponse(data []byte, size int64, ctype string, w http.ResponseWriter) {
+// Returns information on the capabilities of the service.
+func (m *Ico) info() interface{} {
+	conf := m.config()
+	return map[string]interface{}{
+		"formats":     pipeline.Formats(),
+		"s3":          conf.limit.stats(),
+		"processing":  conf.proc.stats(),
+		"fallbacks":   atomic.LoadInt64(&m.fallback),
+		"unavailable": m.unavailable(),
+	}
+}
+
+// Returns the region and bucket names for sources currently unavailable, as determined by their
+// circuit breakers, sorted by name.
+func (m *Ico) unavailable() []string {
+	m.srcLock.RLock()
+	defer m.srcLock.RUnlock()
+
+	list := []string{}
+	for key, src := range m.sources {
+		if src.breaker.open() {
+			list = append(list, key)
+		}
+	}
+
+	sort.Strings(list)
+	return list
+}
+
+// Writes image data back to user. Range and conditional requests are handled as required, and may
+// result in partial or empty responses. Caching headers are set unless already set by the caller.
+// Images compressed with gzip, such as SVG images passed through unchanged, are only written as-is
+// for clients accepting gzip-encoded responses. Responses to HEAD requests have their headers
+// written, including the length of the image data, without the image data itself, as handled by
+// http.ServeContent. The length of gzip-encoded image data is set here, as it is otherwise omitted.
+func (m *Ico) writeResponse(data []byte, ctype string, w http.ResponseWriter, r *http.Request) {
+	data = encodeResponse(data, w, r)
+	if w.Header().Get("Content-Encoding") != "" && r.Header.Get("Range") == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	}
+
 	w.Header().Set("Content-Type", ctype)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
-	w.Header().Set("Cache-Control", "no-transform,public,max-age=86400,s-maxage=2592000")
-	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", m.cacheControl(r))
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
 }
 
-// Package initialization, attaches options and registers service with Mash.
-func init() {
+// The ages, in seconds, for which image responses may be cached by clients and shared caches.
+const (
+	defaultMaxAge       = 86400
+	defaultSharedMaxAge = 2592000
+)
+
+// Returns the 'Cache-Control' header value for image responses to the request given. Cache ages are
+// reduced by up to the percentage configured for jitter, if any, by an amount derived from the request
+// path, so that responses for different images expire at different times, while responses for the
+// same image always have the same cache ages.
+func (m *Ico) cacheControl(r *http.Request) string {
+	maxAge, sharedAge := int64(defaultMaxAge), int64(defaultSharedMaxAge)
+	if jitter := *m.Jitter; jitter > 0 {
+		if jitter > 100 {
+			jitter = 100
+		}
+
+		h := fnv.New64a()
+		h.Write([]byte(r.URL.Path))
+
+		scale := 1 - float64(jitter)/100*float64(h.Sum64()%1000)/1000
+		maxAge, sharedAge = int64(float64(maxAge)*scale), int64(float64(sharedAge)*scale)
+	}
+
+	return fmt.Sprintf("no-transform,public,max-age=%d,s-maxage=%d", maxAge, sharedAge)
+}
+
+// Writes image data back to user with the HTTP status code given, or '200 OK' for unknown status
+// codes. Responses with a status other than '200 OK' are written in full, and range and conditional
+// requests are not handled for them.
+func (m *Ico) writeStatusResponse(status int, data []byte, ctype string, w http.ResponseWriter, r *http.Request) {
+	if status == http.StatusOK || http.StatusText(status) == "" {
+		m.writeResponse(data, ctype, w, r)
+		return
+	}
+
+	data = encodeResponse(data, w, r)
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+
+	if r.Method != "HEAD" {
+		w.Write(data)
+	}
+}
+
+// Sets the perceptual hash for the image given in the 'X-Ico-Hash' response header, computing the
+// hash from the image data if not already computed while processing the image.
+func writeHash(w http.ResponseWriter, img *image.Image) error {
+	if img.Hash == "" {
+		h, err := pipeline.Hash(img)
+		if err != nil {
+			return service.NewError(http.StatusInternalServerError, service.CodeProcessError, "failed to compute hash for image: %s", err)
+		}
+
+		img.Hash = h
+	}
+
+	w.Header().Set("X-Ico-Hash", img.Hash)
+	return nil
+}
+
+// Sets the output format for the image given in the 'X-Ico-Format' response header, for images
+// processed with automatic format selection. Processed images are cached under the parameters given,
+// and thus under 'format=auto', as the format selected only depends on the contents of the image.
+func writeFormat(w http.ResponseWriter, params string, img *image.Image) {
+	for _, p := range strings.Split(params, ",") {
+		if p == "format=auto" {
+			w.Header().Set("X-Ico-Format", img.Type.Name())
+			return
+		}
+	}
+}
+
+// Sets the number of bytes saved by optimizing the image given losslessly, compared to the original
+// image of the size given, in the 'X-Ico-Reduction' response header, for images processed with the
+// 'optimize=lossless' parameter. The header is only set for images processed anew, as the size of
+// the original image is not known for images served from cache.
+func writeReduction(w http.ResponseWriter, params string, size int64, img *image.Image) {
+	for _, p := range strings.Split(params, ",") {
+		if p == "optimize=lossless" {
+			w.Header().Set("X-Ico-Reduction", strconv.FormatInt(size-img.Size, 10))
+			return
+		}
+	}
+}
+
+// Sets the color for the image given, computed with the method given, in the 'X-Ico-Color' response
+// header, computing the color from the image data if not already computed while processing the image.
+func writeColor(w http.ResponseWriter, img *image.Image, method string) error {
+	if img.Color == "" {
+		c, err := pipeline.Color(img, method)
+		if err != nil {
+			return service.NewError(http.StatusInternalServerError, service.CodeProcessError, "failed to compute color for image: %s", err)
+		}
+
+		img.Color = c
+	}
+
+	w.Header().Set("X-Ico-Color", img.Color)
+	return nil
+}
+
+// Returns the image data given in the encoding accepted by the user. Images compressed with gzip are
+// only returned as-is for clients accepting gzip-encoded responses, and are decompressed otherwise.
+func encodeResponse(data []byte, w http.ResponseWriter, r *http.Request) []byte {
+	if image.IsGzip(data) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else if d, err := decompress(data); err == nil {
+			data = d
+		}
+	}
+
+	return data
+}
+
+// Returns the data provided decompressed with gzip.
+func decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Returns a new Ico service sharing the state given, along with the flag set its configuration values
+// are parsed from. Configuration values are set to their defaults until parsed.
+func newIco(st *state) (*Ico, *flag.FlagSet) {
 	flags := flag.NewFlagSet("ico", flag.ContinueOnError)
+	quota, memory := service.Unlimited, service.Unlimited
+	datauri, body := service.Size(defaultDataURIMax), service.Size(defaultMaxBody)
+
 	serv := &Ico{
-		Quota:       flags.Int64("quota", 0, ""),
+		Quota:       &quota,
+		LocalCache:  flags.Bool("local-cache", true, ""),
 		S3Region:    flags.String("s3-region", "", ""),
 		S3Bucket:    flags.String("s3-bucket", "", ""),
 		S3AccessKey: flags.String("s3-access-key", "", ""),
 		S3SecretKey: flags.String("s3-secret-key", "", ""),
-		sources:     make(map[string]*Source),
+		S3Limit:     flags.Int("s3-concurrency", 0, ""),
+		ProcLimit:   flags.Int("concurrency", 0, ""),
+		SourceLimit: &SourceOptions{valid: validLimit},
+		S3Breaker:   flags.Int("s3-breaker", 0, ""),
+		S3Cooldown:  flags.Duration("s3-cooldown", 30*time.Second, ""),
+		RegionHdr:   flags.String("region-header", "X-S3-Region", ""),
+		BucketHdr:   flags.String("bucket-header", "X-S3-Bucket", ""),
+		FontDir:     flags.String("font-dir", "", ""),
+		MaxFrames:   flags.Int64("max-frames", 1000, ""),
+		MaxDim:      flags.Int64("max-dimension", 0, ""),
+		MaxDimError: flags.Bool("dimension-error", false, ""),
+		Defaults:    flags.String("default-params", "", ""),
+		Presets:     &Presets{},
+		Gravity:     &SourceOptions{valid: validGravity.MatchString},
+		Missing:     &SourceOptions{valid: validPath},
+		StripPrefix: &SourceOptions{valid: validPath},
+		AddPrefix:   &SourceOptions{valid: validPath},
+		Formats:     &SourceOptions{valid: validFormats},
+		Sizes:       &SourceOptions{valid: validSizes},
+		Negotiate:   &FormatList{},
+		SizeSnap:    flags.Bool("size-snap", false, ""),
+		Samples:     flags.Int64("latency-samples", defaultLatencySamples, ""),
+		MissingCode: flags.Int("missing-status", http.StatusOK, ""),
+		Timeout:     flags.Duration("timeout", 30*time.Second, ""),
+		Fallback:    flags.Bool("fallback", false, ""),
+		Debug:       flags.Bool("debug", false, ""),
+		DataURIMax:  &datauri,
+		MaxBody:     &body,
+		MaxParams:   flags.Int("max-params", defaultMaxParams, ""),
+		MaxPath:     flags.Int("max-path", defaultMaxPath, ""),
+		MaxVariants: flags.Int("max-variants", defaultMaxVariants, ""),
+		Headers:     &Headers{},
+		Surrogate:   flags.String("surrogate-key", "", ""),
+		ContentKeys: flags.Bool("content-keys", false, ""),
+		Jitter:      flags.Int64("cache-jitter", 0, ""),
+		TokenKey:    flags.String("token-key", "", ""),
+		TokenOnly:   flags.Bool("token-only", false, ""),
+
+		MemoryLimit:    &memory,
+		MemoryInterval: flags.Duration("memory-interval", defaultMemoryInterval, ""),
+		MemoryGC:       flags.Bool("memory-gc", false, ""),
+
+		SweepInterval:  flags.Duration("cache-sweep", 0, ""),
+		SweepTTL:       flags.Duration("cache-ttl", 0, ""),
+		SweepWatermark: flags.Int64("cache-watermark", 0, ""),
+
+		Quality: &pipeline.Qualities{},
+
+		state: st,
 	}
 
+	flags.Var(serv.Quota, "quota", "")
+	flags.Var(serv.MemoryLimit, "memory-limit", "")
+	flags.Var(serv.DataURIMax, "max-datauri", "")
+	flags.Var(serv.MaxBody, "max-body", "")
+	flags.Var(serv.Headers, "extra-headers", "")
+	flags.Var(serv.Presets, "presets", "")
+	flags.Var(serv.Gravity, "default-gravity", "")
+	flags.Var(serv.Missing, "missing-image", "")
+	flags.Var(serv.StripPrefix, "strip-prefix", "")
+	flags.Var(serv.AddPrefix, "add-prefix", "")
+	flags.Var(serv.Formats, "allowed-formats", "")
+	flags.Var(serv.SourceLimit, "source-limit", "")
+	flags.Var(serv.Sizes, "allowed-sizes", "")
+	flags.Var(serv.Negotiate, "accept-formats", "")
+	flags.Var(serv.Quality, "default-quality", "")
+
+	return serv, flags
+}
+
+// Package initialization, attaches options and registers service with Mash. Configuration values are
+// parsed when configuration is first loaded, and whenever configuration is reloaded.
+func init() {
+	serv, _ := newIco(&state{sources: make(map[string]*Source), latency: &sampler{}})
+	serv.current.Store(serv)
+
+	// Report version of linked VIPS library, which determines the formats supported.
+	service.Build.Libraries["libvips"] = pipeline.Version()
+
 	// Register Ico service along with handler methods.
-	service.Register("ico", flags, []service.Handler{
-		{"HEAD", "/:params/*image", serv.Process},
-		{"GET", "/:params/*image", serv.Process},
-		{"DELETE", "/*image", serv.Purge},
+	service.Register("ico", nil, []service.Handler{
+		{"HEAD", "/:params", serv.handle((*Ico).ProcessToken)},
+		{"GET", "/:params", serv.handle((*Ico).ProcessToken)},
+		{"HEAD", "/:params/*image", serv.handle((*Ico).Process)},
+		{"GET", "/:params/*image", serv.handle((*Ico).Process)},
+		{"POST", "/:params", serv.handle((*Ico).ProcessBody)},
+		{"POST", "/:params/*image", serv.handle((*Ico).Variants)},
+		{"DELETE", "/*image", serv.handle((*Ico).Purge)},
 	})
+
+	// Register administrative handler methods.
+	service.RegisterAdmin("ico", []service.Handler{
+		{"GET", "/stats", serv.handle((*Ico).Stats)},
+		{"GET", "/latency", serv.handle((*Ico).Latency)},
+		{"POST", "/warm", serv.handle((*Ico).Warm)},
+		{"GET", "/warm", serv.handle((*Ico).WarmStatus)},
+	})
+
+	service.OnReload(serv.reload)
+	service.OnInfo("ico", serv.info)
+
+	go serv.monitorMemory()
+	go serv.monitorCaches()
 }
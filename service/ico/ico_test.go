@@ -0,0 +1,65 @@
+package ico
+
+import (
+	// Standard library
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  bool
+	}{
+		// Valid paths, in normalized form.
+		{"kittens.jpg", "/kittens.jpg", false},
+		{"/kittens.jpg", "/kittens.jpg", false},
+		{"//header/promo/kittens.jpg", "/header/promo/kittens.jpg", false},
+		{"header//promo///kittens.jpg", "/header/promo/kittens.jpg", false},
+		{"header/./promo/kittens.jpg", "/header/promo/kittens.jpg", false},
+		{"header/promo/", "/header/promo", false},
+		{"header/..kittens.jpg", "/header/..kittens.jpg", false},
+		{"header/kittens%20hats.jpg", "/header/kittens%20hats.jpg", false},
+
+		// Empty paths.
+		{"", "", true},
+		{"/", "", true},
+		{"///", "", true},
+
+		// Paths containing '..' elements.
+		{"..", "", true},
+		{"../kittens.jpg", "", true},
+		{"/../kittens.jpg", "", true},
+		{"header/..", "", true},
+		{"a/../../b", "", true},
+		{"a/b/../c", "", true},
+
+		// Paths containing '..' elements with backslashes as separators.
+		{"..\\kittens.jpg", "", true},
+		{"header\\..\\..\\kittens.jpg", "", true},
+		{"header/..\\kittens.jpg", "", true},
+
+		// Paths containing percent-encoded '..' elements or separators.
+		{"%2e%2e/kittens.jpg", "", true},
+		{"%2E%2E/kittens.jpg", "", true},
+		{"header/.%2e/kittens.jpg", "", true},
+		{"header%2f..%2fkittens.jpg", "", true},
+		{"header%5c..%5ckittens.jpg", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := cleanPath(tt.name)
+		if tt.err {
+			if err == nil {
+				t.Errorf("cleanPath(%q) = %q, want error", tt.name, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("cleanPath(%q) returned error: %s", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package image
+
+import (
+	// Standard library.
+	"encoding/binary"
+	"strings"
+)
+
+// Kind represents the format for an image file. Kinds are also used for identifying formats in the
+// pipeline package, including its C sources, and their values are not to be changed.
+type Kind int
+
+const (
+	JPEG Kind = iota
+	PNG
+	GIF
+	AVIF
+	WEBP
+	HEIF
+	SVG
+)
+
+// A signature is a sequence of bytes found at a fixed offset in files of a specific format.
+type signature struct {
+	offset int
+	data   string
+}
+
+// A format describes an image format handled by Ico, and is the single source of information on each
+// format, as identified by its Kind. Adding support for a format requires adding an entry here, as
+// well as any VIPS operations required for loading and saving images in the pipeline package.
+type format struct {
+	name   string      // The short name for the format, as used in pipeline parameters.
+	mime   string      // The MIME type for the format.
+	ext    string      // The canonical file extension for the format.
+	magic  []signature // The file signatures for the format, all of which are required to match.
+	brands []string    // The ISO base media file brands for the format, placed after the 'ftyp' box type.
+}
+
+// The list of formats handled by Ico, indexed by their Kind. Formats without any file signature or
+// brand, such as SVG, are detected separately.
+var formats = [...]format{
+	JPEG: {name: "jpeg", mime: "image/jpeg", ext: ".jpg", magic: []signature{{0, "\xff\xd8"}}},
+	PNG:  {name: "png", mime: "image/png", ext: ".png", magic: []signature{{0, "\x89\x50"}}},
+	GIF:  {name: "gif", mime: "image/gif", ext: ".gif", magic: []signature{{0, "\x47\x49"}}},
+	AVIF: {name: "avif", mime: "image/avif", ext: ".avif", brands: []string{"avif", "avis"}},
+	WEBP: {name: "webp", mime: "image/webp", ext: ".webp", magic: []signature{{0, "RIFF"}, {8, "WEBP"}}},
+	HEIF: {name: "heif", mime: "image/heif", ext: ".heic", brands: []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"}},
+	SVG:  {name: "svg", mime: "image/svg+xml", ext: ".svg"},
+}
+
+// String returns the internal representation of the image Kind as a MIME type.
+func (k *Kind) String() string {
+	if !k.valid() {
+		return ""
+	}
+
+	return formats[*k].mime
+}
+
+// Name returns the short name for the image Kind, e.g. 'jpeg', as used in pipeline parameters.
+func (k *Kind) Name() string {
+	if !k.valid() {
+		return ""
+	}
+
+	return formats[*k].name
+}
+
+// Extension returns the canonical file extension for the image Kind, including the leading dot.
+func (k *Kind) Extension() string {
+	if !k.valid() {
+		return ""
+	}
+
+	return formats[*k].ext
+}
+
+// Returns true if the Kind corresponds to a known format.
+func (k *Kind) valid() bool {
+	return *k >= 0 && int(*k) < len(formats)
+}
+
+// Kinds returns the list of all image kinds handled by Ico.
+func Kinds() []Kind {
+	kinds := make([]Kind, len(formats))
+	for i := range formats {
+		kinds[i] = Kind(i)
+	}
+
+	return kinds
+}
+
+// ParseKind returns the image Kind for the short name given, e.g. 'jpeg', and false if no format by
+// that name is handled by Ico.
+func ParseKind(name string) (Kind, bool) {
+	for i, f := range formats {
+		if f.name == name {
+			return Kind(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// ParseMIME returns the image Kind for the MIME type given, e.g. 'image/jpeg', ignoring any
+// parameters and letter case, and false if no format with that MIME type is handled by Ico.
+func ParseMIME(ctype string) (Kind, bool) {
+	if i := strings.Index(ctype, ";"); i >= 0 {
+		ctype = ctype[:i]
+	}
+
+	ctype = strings.ToLower(strings.TrimSpace(ctype))
+	for i, f := range formats {
+		if f.mime == ctype {
+			return Kind(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// Returns the image Kind matching the file signature or ISO base media file brand for the data
+// buffer provided, and false if no format matches.
+func detectKind(data []byte) (Kind, bool) {
+	for i, f := range formats {
+		if len(f.magic) > 0 && matchSignature(data, f.magic) {
+			return Kind(i), true
+		}
+	}
+
+	// Check for image types based on the ISO base media file format.
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		for i, f := range formats {
+			for _, b := range f.brands {
+				if string(data[8:12]) == b {
+					return Kind(i), true
+				}
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// Returns true if the data buffer provided can be loaded as an image of the Kind given, i.e. if it
+// matches the file signature for the Kind, or contains any of its ISO base media file brands as the
+// major brand or as a compatible brand. Unlike detectKind, this accepts files whose major brand
+// belongs to another format, such as AVIF images with a major brand of 'mif1'.
+func matchKind(data []byte, k Kind) bool {
+	if !k.valid() {
+		return false
+	}
+
+	f := formats[k]
+	switch {
+	case len(f.magic) > 0:
+		return matchSignature(data, f.magic)
+	case len(f.brands) > 0:
+		return matchBrands(data, f.brands)
+	case k == SVG:
+		return isSVG(data)
+	}
+
+	return false
+}
+
+// Returns true if the data buffer provided starts with an ISO base media file type box containing
+// any of the brands given, either as the major brand or as a compatible brand.
+func matchBrands(data []byte, brands []string) bool {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+
+	// The box size covers the size and type fields, along with the major brand, minor version and
+	// list of compatible brands, in turn.
+	size := int(binary.BigEndian.Uint32(data[0:4]))
+	if size > len(data) {
+		size = len(data)
+	}
+
+	for i := 8; i+4 <= size; i += 4 {
+		// Skip minor version, which is placed between the major and compatible brands.
+		if i == 12 {
+			continue
+		}
+
+		for _, b := range brands {
+			if string(data[i:i+4]) == b {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns true if all signatures given match the data buffer provided.
+func matchSignature(data []byte, magic []signature) bool {
+	for _, m := range magic {
+		if len(data) < m.offset+len(m.data) || string(data[m.offset:m.offset+len(m.data)]) != m.data {
+			return false
+		}
+	}
+
+	return true
+}
@@ -2,64 +2,113 @@ package image
 
 import (
 	// Standard library.
-	"fmt"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
 )
 
-// Kind represents the MIME type for an image file.
-type Kind int
+// Image represents a processed image, and contains the image data as a byte
+// slice along with other useful information about the image.
+type Image struct {
+	Data  []byte // The image data buffer
+	Size  int64  // The image size, in bytes.
+	Type  Kind   // The image format, which also determines its MIME type.
+	Hash  string // The perceptual hash of the image, in hexadecimal notation, if computed.
+	Color string // The average or dominant color of the image, in hexadecimal RGB notation, if computed.
+}
 
-const (
-	JPEG Kind = iota
-	PNG
-	GIF
-)
+// The number of bytes searched for the root element of SVG images.
+const svgHeadSize = 4096
 
-var kindTypeLookup = map[Kind]string{
-	JPEG: "image/jpeg",
-	PNG:  "image/png",
-	GIF:  "image/gif",
-}
+// Returns true if the data buffer provided contains an SVG image, optionally compressed with gzip.
+// The data buffer is expected to start with an XML declaration or element, and contain the root
+// SVG element within its first few kilobytes. SVG images compressed with Brotli are not supported,
+// as Brotli streams have no file signature, and are not detected as SVG images.
+func isSVG(data []byte) bool {
+	head := data
+	if IsGzip(data) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return false
+		}
+
+		head = make([]byte, svgHeadSize)
+		n, _ := io.ReadFull(r, head)
+		head = head[:n]
+	}
 
-// String returns the internal representation of the image Kind as a MIME type.
-func (k *Kind) String() string {
-	return kindTypeLookup[*k]
+	if len(head) > svgHeadSize {
+		head = head[:svgHeadSize]
+	}
+
+	head = bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")))
+	return bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<svg"))
 }
 
-// Image represents a processed image, and contains the image data as a byte
-// slice along with other useful information about the image.
-type Image struct {
-	Data []byte // The image data buffer
-	Size int64  // The image size, in bytes.
-	Type Kind   // The image MIME type.
+// IsGzip returns true if the data buffer provided is compressed with gzip.
+func IsGzip(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
 }
 
-// The file signature, used for determining the type of file.
-type magicHeader [2]byte
+// The minimum size for image data, in bytes, below which no image type can be determined.
+const minSize = 2
 
-// A lookup table of magic numbers against image file types.
-var magicHeaderLookup = map[magicHeader]Kind{
-	magicHeader{0xff, 0xd8}: JPEG,
-	magicHeader{0x89, 0x50}: PNG,
-	magicHeader{0x47, 0x49}: GIF,
-}
+// ErrEmpty is returned for data buffers too small to contain an image, e.g. for images left empty by
+// failed uploads.
+var ErrEmpty = errors.New("source image is empty or truncated")
 
-// New creates a new image representation for the data buffer provided. It returns
-// an error if the data buffer is empty or does not correspond to any known image
+// ErrUnknownType is returned for data buffers not corresponding to any known image
 // type handled by Ico.
+var ErrUnknownType = errors.New("unknown or unhandled file type for data buffer")
+
+// New creates a new image representation for the data buffer provided. It returns
+// ErrEmpty if the data buffer is empty, and ErrUnknownType if the data buffer does
+// not correspond to any known image type handled by Ico.
 func New(data []byte) (*Image, error) {
 	// Check for valid image length before processing.
 	l := int64(len(data))
-	if l < 2 {
-		return nil, fmt.Errorf("cannot use data buffer of length '%d' as image", l)
+	if l < minSize {
+		return nil, ErrEmpty
+	}
+
+	// Check for image types with a file signature or brand.
+	if k, ok := detectKind(data); ok {
+		return &Image{Data: data, Size: l, Type: k}, nil
+	}
+
+	// Check for SVG images, which are text-based and have no fixed file signature.
+	if isSVG(data) {
+		return &Image{Data: data, Size: l, Type: SVG}, nil
+	}
+
+	return nil, ErrUnknownType
+}
+
+// ErrTypeMismatch is returned for data buffers that cannot be loaded as the image type given for
+// them, e.g. in a 'Content-Type' header.
+var ErrTypeMismatch = errors.New("content type given does not match type of image data")
+
+// NewWithType creates a new image representation for the data buffer provided, using the content
+// type given as the image type, if it corresponds to a known image type and the data buffer can be
+// loaded as that type, and returns ErrTypeMismatch if it cannot. Content types not corresponding to
+// any known image type, e.g. 'application/octet-stream', are ignored, in which case the image type
+// is determined from the data buffer, as with New.
+func NewWithType(data []byte, ctype string) (*Image, error) {
+	k, ok := ParseMIME(ctype)
+	if !ok {
+		return New(data)
 	}
 
-	// Check for valid image MIME type.
-	var m magicHeader
-	copy(m[:], data[:2])
+	// Check for valid image length before processing.
+	l := int64(len(data))
+	if l < minSize {
+		return nil, ErrEmpty
+	}
 
-	if _, ok := magicHeaderLookup[m]; !ok {
-		return nil, fmt.Errorf("unknown or unhandled file type for data buffer")
+	if !matchKind(data, k) {
+		return nil, ErrTypeMismatch
 	}
 
-	return &Image{Data: data, Size: l, Type: magicHeaderLookup[m]}, nil
+	return &Image{Data: data, Size: l, Type: k}, nil
 }
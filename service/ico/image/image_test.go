@@ -0,0 +1,59 @@
+package image
+
+import (
+	// Standard library.
+	"testing"
+)
+
+// Returns the start of an ISO base media file with the major and compatible brands given, as found
+// in AVIF and HEIF images.
+func ftyp(major string, compatible ...string) []byte {
+	size := 16 + 4*len(compatible)
+	data := []byte{0, 0, 0, byte(size)}
+	data = append(data, "ftyp"+major+"\x00\x00\x00\x00"...)
+	for _, b := range compatible {
+		data = append(data, b...)
+	}
+
+	return append(data, "\x00\x00\x00\x08mdat"...)
+}
+
+func TestNewWithType(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF")
+	tests := []struct {
+		name  string
+		data  []byte
+		ctype string
+		want  Kind
+		err   error
+	}{
+		// Content types matching the image data.
+		{"jpeg", jpeg, "image/jpeg", JPEG, nil},
+		{"jpeg with parameters", jpeg, "Image/JPEG; charset=binary", JPEG, nil},
+		{"svg", []byte("<svg xmlns='http://www.w3.org/2000/svg'/>"), "image/svg+xml", SVG, nil},
+
+		// Content types taking precedence over ambiguous image data, which is detected as another type.
+		{"avif with major brand 'mif1'", ftyp("mif1", "avif", "miaf"), "image/avif", AVIF, nil},
+		{"heif with major brand 'mif1'", ftyp("mif1", "heic"), "image/heif", HEIF, nil},
+
+		// Content types not corresponding to any known image type.
+		{"no content type", jpeg, "", JPEG, nil},
+		{"generic content type", jpeg, "application/octet-stream", JPEG, nil},
+		{"unknown data", []byte("kittens"), "application/octet-stream", 0, ErrUnknownType},
+
+		// Content types the image data cannot be loaded as.
+		{"jpeg as png", jpeg, "image/png", 0, ErrTypeMismatch},
+		{"heif as avif", ftyp("heic", "mif1", "heic"), "image/avif", 0, ErrTypeMismatch},
+		{"jpeg as svg", jpeg, "image/svg+xml", 0, ErrTypeMismatch},
+		{"empty", []byte("\xff"), "image/jpeg", 0, ErrEmpty},
+	}
+
+	for _, tt := range tests {
+		img, err := NewWithType(tt.data, tt.ctype)
+		if err != tt.err {
+			t.Errorf("NewWithType() for %s returned error '%v', want '%v'", tt.name, err, tt.err)
+		} else if err == nil && img.Type != tt.want {
+			t.Errorf("NewWithType() for %s returned type '%s', want '%s'", tt.name, img.Type.String(), tt.want.String())
+		}
+	}
+}
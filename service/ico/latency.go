@@ -0,0 +1,83 @@
+package ico
+
+import (
+	// Standard library
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	// Internal packages
+	"github.com/deuill/mash/service"
+)
+
+// The default number of samples kept for processing latencies.
+const defaultLatencySamples = 1024
+
+// A sampler keeps a fixed number of the most recent latencies recorded, from which percentiles may be
+// computed. Samplers are safe for concurrent use.
+type sampler struct {
+	samples []time.Duration // A ring buffer of the most recent samples.
+	next    int             // The position in the ring buffer the next sample is recorded at.
+	count   int64           // The total number of samples recorded.
+
+	sync.Mutex // Used for controlling concurrent access to samples.
+}
+
+// LatencyStats represents percentiles for the most recent latencies recorded, in milliseconds.
+type LatencyStats struct {
+	Samples int     `json:"samples"` // The number of samples percentiles are computed from.
+	Total   int64   `json:"total"`   // The total number of samples recorded.
+	P50     float64 `json:"p50"`
+	P95     float64 `json:"p95"`
+	P99     float64 `json:"p99"`
+}
+
+// Records the latency given, replacing the oldest sample recorded if the sampler is full, where the
+// sampler keeps the number of samples given. Samples are discarded whenever the number of samples kept
+// changes.
+func (s *sampler) record(d time.Duration, size int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if n := int(size); n <= 0 {
+		return
+	} else if cap(s.samples) != n {
+		s.samples, s.next = make([]time.Duration, 0, n), 0
+	}
+
+	if len(s.samples) < cap(s.samples) {
+		s.samples = append(s.samples, d)
+	} else {
+		s.samples[s.next] = d
+	}
+
+	s.next = (s.next + 1) % cap(s.samples)
+	s.count++
+}
+
+// Returns percentiles for the samples currently kept, using the nearest-rank method.
+func (s *sampler) stats() LatencyStats {
+	s.Lock()
+	sorted := append([]time.Duration(nil), s.samples...)
+	total := s.count
+	s.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) float64 {
+		if len(sorted) == 0 {
+			return 0
+		}
+
+		rank := (p*len(sorted) + 99) / 100
+		return float64(sorted[rank-1]) / float64(time.Millisecond)
+	}
+
+	return LatencyStats{len(sorted), total, percentile(50), percentile(95), percentile(99)}
+}
+
+// Latency returns percentiles for the time taken to process images for the most recent requests, in
+// milliseconds. Only requests processing images are sampled, and requests served from cache are not.
+func (m *Ico) Latency(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+	return &service.Response{http.StatusOK, m.latency.stats()}, nil
+}
@@ -0,0 +1,69 @@
+package ico
+
+import (
+	// Standard library
+	"sync/atomic"
+)
+
+// A limiter bounds the number of concurrent operations, having any operations above the limit wait
+// until a running operation completes. A nil limiter places no bounds on operations.
+type limiter struct {
+	slots  chan struct{} // A buffered channel with a slot for each operation allowed to run.
+	queued int64         // The number of operations waiting to run, updated atomically.
+}
+
+// LimiterStats represents usage statistics for a limiter.
+type LimiterStats struct {
+	Limit  int   `json:"limit"`  // The maximum number of concurrent operations. Zero means no limit.
+	Active int   `json:"active"` // The number of operations currently running.
+	Queued int64 `json:"queued"` // The number of operations waiting to run.
+}
+
+// Returns a limiter allowing for up to n concurrent operations, or nil if n is zero or negative.
+func newLimiter(n int) *limiter {
+	if n <= 0 {
+		return nil
+	}
+
+	return &limiter{slots: make(chan struct{}, n)}
+}
+
+// Waits until the operation is allowed to run. Calls must be paired with calls to release.
+func (l *limiter) acquire() {
+	if l == nil {
+		return
+	}
+
+	atomic.AddInt64(&l.queued, 1)
+	l.slots <- struct{}{}
+	atomic.AddInt64(&l.queued, -1)
+}
+
+// Marks a running operation as completed, allowing any waiting operations to run.
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+
+	<-l.slots
+}
+
+// Returns usage statistics for the limiter.
+func (l *limiter) stats() LimiterStats {
+	if l == nil {
+		return LimiterStats{}
+	}
+
+	return LimiterStats{cap(l.slots), len(l.slots), atomic.LoadInt64(&l.queued)}
+}
+
+// Returns the limiter given if it allows for up to n concurrent operations, or a new limiter
+// otherwise, so that operations running while configuration is reloaded still count against limits
+// left unchanged.
+func reuseLimiter(l *limiter, n int) *limiter {
+	if l.stats().Limit == n || (l == nil && n <= 0) {
+		return l
+	}
+
+	return newLimiter(n)
+}
@@ -0,0 +1,45 @@
+package ico
+
+import (
+	// Standard library
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	// Internal packages
+	"github.com/deuill/mash/service/ico/pipeline"
+)
+
+// The interval used for checking memory usage, if no valid interval has been configured.
+const defaultMemoryInterval = 10 * time.Second
+
+// Checks memory usage periodically, dropping all operations cached by the VIPS library whenever
+// memory allocated on the heap exceeds the configured limit, and optionally forcing a garbage
+// collection cycle. Configuration values are read on every check, and thus may be reloaded.
+func (m *Ico) monitorMemory() {
+	for {
+		conf := m.config()
+		interval := *conf.MemoryInterval
+		if interval <= 0 {
+			interval = defaultMemoryInterval
+		}
+
+		time.Sleep(interval)
+
+		if *conf.MemoryLimit < 0 {
+			continue
+		}
+
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+
+		if int64(stats.HeapAlloc) <= int64(*conf.MemoryLimit) {
+			continue
+		}
+
+		pipeline.DropCache()
+		if *conf.MemoryGC {
+			debug.FreeOSMemory()
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package ico
+
+import (
+	// Standard library
+	"net/http"
+	"strconv"
+	"strings"
+
+	// Internal packages
+	"github.com/deuill/mash/service/ico/image"
+	"github.com/deuill/mash/service/ico/pipeline"
+)
+
+// Returns the pipeline parameters given with the output format negotiated for the request, if format
+// negotiation is enabled and the parameters given do not already request a format. The format chosen
+// is the first format in the configured list that is explicitly accepted in the 'Accept' header for
+// the request, that the linked VIPS library can write images in, and that is allowed for the source.
+// The parameters given are returned unchanged if no format matches, in which case images are written
+// in their original format. Responses are marked as varying by the 'Accept' header in either case.
+func (m *Ico) negotiateFormat(w http.ResponseWriter, r *http.Request, src *Source, params string) string {
+	if len(*m.Negotiate) == 0 {
+		return params
+	}
+
+	for _, f := range strings.Split(params, ",") {
+		if strings.HasPrefix(f, "format=") {
+			return params
+		}
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	accepted := acceptedTypes(r.Header.Get("Accept"))
+	allowed := m.Formats.get(src)
+	supported := pipeline.Formats()
+
+	for _, name := range *m.Negotiate {
+		k, _ := image.ParseKind(name)
+		if !accepted[k.String()] || !supported[name].Save {
+			continue
+		} else if allowed != "" && !strings.Contains("|"+allowed+"|", "|"+name+"|") {
+			continue
+		}
+
+		return params + ",format=" + name
+	}
+
+	return params
+}
+
+// Returns the set of media types explicitly accepted in the 'Accept' header value given. Wildcard
+// types, such as 'image/*', and types given with a quality value of zero are not included.
+func acceptedTypes(header string) map[string]bool {
+	types := make(map[string]bool)
+	for _, f := range strings.Split(header, ",") {
+		parts := strings.Split(f, ";")
+		mime := strings.ToLower(strings.TrimSpace(parts[0]))
+		if mime == "" || strings.Contains(mime, "*") {
+			continue
+		}
+
+		accept := true
+		for _, p := range parts[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				accept = err == nil && q > 0
+			}
+		}
+
+		if accept {
+			types[mime] = true
+		}
+	}
+
+	return types
+}
@@ -0,0 +1,238 @@
+package ico
+
+import (
+	// Standard library
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	// Internal packages
+	"github.com/deuill/mash/service"
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// SourceOptions represents option values set for individual sources, indexed under the source region
+// and bucket name. Values can be set from configuration as a comma-separated list of sources and
+// values, e.g. 'us-east-1/portraits:top,us-east-1/products:focus'.
+type SourceOptions struct {
+	values map[string]string
+	valid  func(value string) bool // Returns true if the value given is valid for the option.
+}
+
+// Set parses option values from the value provided, and is used for setting values from
+// configuration.
+func (o *SourceOptions) Set(value string) error {
+	result := make(map[string]string)
+	for _, f := range strings.Split(value, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		v := strings.SplitN(f, ":", 2)
+		if len(v) < 2 || !strings.Contains(v[0], "/") {
+			return fmt.Errorf("unable to parse malformed value '%s'", f)
+		}
+
+		if o.valid != nil && !o.valid(v[1]) {
+			return fmt.Errorf("value '%s' for source '%s' is not valid", v[1], v[0])
+		}
+
+		result[v[0]] = v[1]
+	}
+
+	o.values = result
+	return nil
+}
+
+// String returns the option values as a comma-separated list, sorted by source.
+func (o *SourceOptions) String() string {
+	var list []string
+	for src, value := range o.values {
+		list = append(list, src+":"+value)
+	}
+
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// Returns the option value set for the source given, or an empty string if no value is set.
+func (o *SourceOptions) get(src *Source) string {
+	return o.values[src.key()]
+}
+
+// FormatList represents an ordered list of output format names. Lists can be set from configuration
+// as a comma-separated list of format names, e.g. 'avif,webp,jpeg'.
+type FormatList []string
+
+// Set parses format names from the value provided, and is used for setting lists from configuration.
+func (f *FormatList) Set(value string) error {
+	var result FormatList
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		if _, ok := image.ParseKind(name); !ok {
+			return fmt.Errorf("unknown format '%s'", name)
+		}
+
+		result = append(result, name)
+	}
+
+	*f = result
+	return nil
+}
+
+// String returns the format names as a comma-separated list, in order.
+func (f *FormatList) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Presets represents pipeline parameters for named presets, which may be referenced in requests via
+// the 'preset' parameter in place of the parameters themselves. Presets can be set from configuration
+// as a space-separated list of names and parameters, e.g. 'thumb:width=200,fit=crop hero:width=1600'.
+type Presets map[string]string
+
+// Matches names that may be given to presets.
+var validPreset = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Set parses presets from the value provided, and is used for setting presets from configuration.
+func (p *Presets) Set(value string) error {
+	result := make(Presets)
+	for _, f := range strings.Fields(value) {
+		v := strings.SplitN(f, ":", 2)
+		if len(v) < 2 || v[1] == "" {
+			return fmt.Errorf("unable to parse malformed preset '%s'", f)
+		}
+
+		if !validPreset.MatchString(v[0]) {
+			return fmt.Errorf("preset name '%s' is not valid", v[0])
+		}
+
+		result[v[0]] = v[1]
+	}
+
+	*p = result
+	return nil
+}
+
+// String returns the presets as a space-separated list, sorted by name.
+func (p *Presets) String() string {
+	var list []string
+	for name, params := range *p {
+		list = append(list, name+":"+params)
+	}
+
+	sort.Strings(list)
+	return strings.Join(list, " ")
+}
+
+// Returns the pipeline parameters given with any 'preset' parameter replaced by the parameters for
+// the preset named. Any other parameters given override parameters of the same name in the preset.
+// Parameters without a 'preset' parameter are returned unchanged, and an error is returned if the
+// preset named does not exist.
+func (p *Presets) resolve(params string) (string, error) {
+	var name string
+	var fields []string
+
+	for _, f := range strings.Split(params, ",") {
+		if strings.HasPrefix(f, "preset=") {
+			name = strings.TrimPrefix(f, "preset=")
+		} else {
+			fields = append(fields, f)
+		}
+	}
+
+	if name == "" {
+		return params, nil
+	}
+
+	preset, ok := (*p)[name]
+	if !ok {
+		return "", service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "preset '%s' does not exist", name)
+	}
+
+	result := strings.Split(preset, ",")
+	for _, f := range fields {
+		key, replaced := strings.SplitN(f, "=", 2)[0]+"=", false
+		for i := range result {
+			if strings.HasPrefix(result[i], key) {
+				result[i], replaced = f, true
+			}
+		}
+
+		if !replaced {
+			result = append(result, f)
+		}
+	}
+
+	return strings.Join(result, ","), nil
+}
+
+// Matches crop gravities that may be set as defaults, which excludes crop points.
+var validGravity = regexp.MustCompile(`^(top|bottom|left|right|center|focus(:(top|bottom|left|right|center))?)$`)
+
+// Returns true if the path given is valid for use as an image path.
+func validPath(name string) bool {
+	_, err := cleanPath(name)
+	return err == nil
+}
+
+// Returns true if the value given is a '|'-separated list of known image formats, e.g. 'webp|avif'.
+func validFormats(value string) bool {
+	for _, name := range strings.Split(value, "|") {
+		if _, ok := image.ParseKind(name); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns true if the value given is a positive number of concurrent operations, e.g. '4'.
+func validLimit(value string) bool {
+	n, err := strconv.Atoi(value)
+	return err == nil && n > 0
+}
+
+// Returns the combinations of width and height in the '|'-separated list given, e.g. '200x0|400x300',
+// where a zero width or height stands for an unset dimension.
+func parseSizes(value string) ([][2]int64, error) {
+	var sizes [][2]int64
+	for _, f := range strings.Split(value, "|") {
+		var w, h int64
+		if n, err := fmt.Sscanf(f, "%dx%d", &w, &h); err != nil || n != 2 || w < 0 || h < 0 || fmt.Sprintf("%dx%d", w, h) != f {
+			return nil, fmt.Errorf("size '%s' is not in the form 'widthxheight'", f)
+		}
+
+		sizes = append(sizes, [2]int64{w, h})
+	}
+
+	return sizes, nil
+}
+
+// Returns true if the value given is a '|'-separated list of sizes, as accepted by parseSizes.
+func validSizes(value string) bool {
+	_, err := parseSizes(value)
+	return err == nil
+}
+
+// Returns the pipeline parameters given with the gravity provided applied to any crop fit mode set
+// without an explicit gravity. Parameters are returned unchanged if the gravity is empty.
+func cropGravity(params, gravity string) string {
+	if gravity == "" {
+		return params
+	}
+
+	fields := strings.Split(params, ",")
+	for i, f := range fields {
+		if f == "fit=crop" {
+			fields[i] = "fit=crop:" + gravity
+		}
+	}
+
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,126 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "color.h"
+import "C"
+
+import (
+	// Standard library.
+	"fmt"
+	"unsafe"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// The methods colors may be computed with for images. The average color is the
+// mean of all pixel colors, while the dominant color is the mean of the most
+// common group of similar pixel colors.
+const (
+	ColorAverage  = "average"
+	ColorDominant = "dominant"
+)
+
+// The size of the image colors are computed from, and the number of bits kept
+// for each color component when grouping similar colors.
+const (
+	colorSize = 64
+	colorBits = 4
+)
+
+// Color returns the color for the image provided, computed with the method given,
+// in hexadecimal RGB notation, as described for imageColor. The image data is
+// decoded in order to compute the color, and images processed against a pipeline
+// may have their color computed while processing instead, by setting
+// Pipeline.Color.
+func Color(img *image.Image, method string) (string, error) {
+	if err := Init(); err != nil {
+		return "", err
+	}
+
+	if err := checkLoad(img); err != nil {
+		return "", err
+	}
+
+	ptr, err := C.ico_image_new(unsafe.Pointer(&img.Data[0]), C.size_t(img.Size), C.int(img.Type))
+	if err != nil {
+		return "", decodeError(img)
+	}
+
+	defer C.ico_image_destroy(ptr)
+
+	return imageColor(ptr, method)
+}
+
+// Returns the color for the image provided, computed with the method given, in
+// hexadecimal RGB notation. The image is reduced to a 64x64 sRGB image, and pixel
+// colors are weighted by their opacity, so that transparent areas are ignored,
+// unless the image is fully transparent. For dominant colors, pixel colors are
+// grouped by their 4 most significant bits for each component, and the mean
+// color of the group with the greatest weight is returned.
+func imageColor(img *C.ico_image, method string) (string, error) {
+	if method != ColorAverage && method != ColorDominant {
+		return "", fmt.Errorf("unknown method '%s' for computing color", method)
+	}
+
+	pixels := make([]byte, colorSize*colorSize*4)
+	if _, err := C.ico_image_color_pixels(img, C.int(colorSize), (*C.uchar)(unsafe.Pointer(&pixels[0]))); err != nil {
+		return "", fmt.Errorf("failed to compute color for image: %s", vipsError())
+	}
+
+	type group struct{ r, g, b, weight float64 }
+	groups := make(map[int]*group)
+
+	var total float64
+	for i := 0; i < len(pixels); i += 4 {
+		total += float64(pixels[i+3])
+	}
+
+	// Pixels are all placed in a single group when computing average colors.
+	for i := 0; i < len(pixels); i += 4 {
+		var key int
+		if method == ColorDominant {
+			shift := uint(8 - colorBits)
+			key = int(pixels[i])>>shift<<(2*colorBits) | int(pixels[i+1])>>shift<<colorBits | int(pixels[i+2])>>shift
+		}
+
+		w := float64(pixels[i+3])
+		if total == 0 {
+			w = 1
+		}
+
+		g, ok := groups[key]
+		if !ok {
+			g = &group{}
+			groups[key] = g
+		}
+
+		g.r, g.g, g.b, g.weight = g.r+w*float64(pixels[i]), g.g+w*float64(pixels[i+1]), g.b+w*float64(pixels[i+2]), g.weight+w
+	}
+
+	// Find group with the greatest weight, breaking ties by lowest key.
+	var best *group
+	var bestKey int
+	for k, g := range groups {
+		if best == nil || g.weight > best.weight || (g.weight == best.weight && k < bestKey) {
+			best, bestKey = g, k
+		}
+	}
+
+	if best == nil || best.weight == 0 {
+		return formatColor(0, 0, 0), nil
+	}
+
+	return formatColor(best.r/best.weight, best.g/best.weight, best.b/best.weight), nil
+}
+
+// Returns the color components provided in hexadecimal RGB notation, e.g. 'ff0000'.
+func formatColor(r, g, b float64) string {
+	return fmt.Sprintf("%02x%02x%02x", uint8(r+0.5), uint8(g+0.5), uint8(b+0.5))
+}
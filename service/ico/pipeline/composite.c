@@ -0,0 +1,66 @@
+#include <errno.h>
+#include <stdlib.h>
+#include <vips/vips.h>
+
+#include "pipeline.h"
+#include "composite.h"
+
+void ico_image_composite(ico_image *img, ico_image *overlay, int x, int y, double opacity) {
+	VipsImage *tmp = NULL;
+	int i, bands, alpha = vips_image_hasalpha(img->internal);
+
+	// Add an opaque alpha channel to the overlay image, if none exists.
+	if (!vips_image_hasalpha(overlay->internal)) {
+		if (vips_bandjoin_const1(overlay->internal, &tmp, 255, NULL) != 0) {
+			errno = 1;
+			return;
+		}
+
+		g_object_unref(overlay->internal);
+		overlay->internal = tmp;
+	}
+
+	// Scale the overlay alpha channel by the opacity factor, leaving other channels intact.
+	if (opacity < 1) {
+		bands = vips_image_get_bands(overlay->internal);
+		double a[bands], b[bands];
+
+		for (i = 0; i < bands; i++) {
+			a[i] = 1;
+			b[i] = 0;
+		}
+
+		a[bands - 1] = opacity;
+
+		if (vips_linear(overlay->internal, &tmp, a, b, bands, "uchar", 1, NULL) != 0) {
+			errno = 1;
+			return;
+		}
+
+		g_object_unref(overlay->internal);
+		overlay->internal = tmp;
+	}
+
+	// Place overlay image over base image at the given position.
+	if (vips_composite2(img->internal, overlay->internal, &tmp, VIPS_BLEND_MODE_OVER, "x", x, "y", y, NULL) != 0) {
+		errno = 1;
+		return;
+	}
+
+	g_object_unref(img->internal);
+	img->internal = tmp;
+
+	// Remove the alpha channel added during compositing, if the base image had none.
+	if (!alpha) {
+		if (vips_flatten(img->internal, &tmp, NULL) != 0) {
+			errno = 1;
+			return;
+		}
+
+		g_object_unref(img->internal);
+		img->internal = tmp;
+	}
+
+	errno = 0;
+	return;
+}
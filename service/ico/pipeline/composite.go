@@ -0,0 +1,111 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "composite.h"
+import "C"
+
+import (
+	// Standard library.
+	"encoding/base64"
+	"fmt"
+	"path"
+	"unsafe"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// Composite is an operation for placing a secondary image, fetched from the
+// same source as the original image, over the processed image.
+type Composite struct {
+	Image   string  `key:"composite" valid:"^[A-Za-z0-9_-]+$"`
+	X       int64   `key:"composite-x"`
+	Y       int64   `key:"composite-y"`
+	Width   int64   `key:"composite-width"`
+	Height  int64   `key:"composite-height"`
+	Opacity float64 `key:"composite-opacity" default:"1"`
+
+	name    string       // The decoded name for the overlay image.
+	overlay *image.Image // The overlay image, as fetched on load.
+}
+
+// Load fetches the overlay image for compositing using the function provided.
+func (c *Composite) Load(fetch FetchFunc) error {
+	img, err := fetch(c.name)
+	if err != nil {
+		return fmt.Errorf("failed to fetch composite image '%s': %s", c.name, err)
+	}
+
+	c.overlay = img
+	return nil
+}
+
+// Process places the overlay image over the image provided, resizing the
+// overlay image beforehand if needed. Returns an error if processing fails for
+// any reason.
+func (c *Composite) Process(handle *Handle) error {
+	img := (*C.ico_image)(handle)
+
+	if c.overlay == nil {
+		return fmt.Errorf("composite image '%s' has not been loaded", c.name)
+	}
+
+	// Initialize internal representation for overlay image.
+	ptr, err := C.ico_image_new(unsafe.Pointer(&c.overlay.Data[0]), C.size_t(c.overlay.Size), C.int(c.overlay.Type))
+	if err != nil {
+		return fmt.Errorf("failed to initialize composite image: %s", vipsError())
+	}
+
+	defer C.ico_image_destroy(ptr)
+
+	// Resize overlay image to fit within the requested dimensions, if any.
+	if c.Width > 0 || c.Height > 0 {
+		r := &Resize{Width: c.Width, Height: c.Height}
+		r.Fit.Kind = "clip"
+
+		if err = r.Process((*Handle)(ptr)); err != nil {
+			return err
+		}
+	}
+
+	_, err = C.ico_image_composite(img, ptr, C.int(c.X), C.int(c.Y), C.double(c.Opacity))
+	if err != nil {
+		return fmt.Errorf("failed to composite image: %s", vipsError())
+	}
+
+	return nil
+}
+
+// NewComposite attempts to initialize a composite operation from the
+// parameters provided. The overlay image name is expected to be encoded in
+// unpadded, URL-safe base64, and the operation is skipped if no name is given.
+func NewComposite(p *Params) (Operation, error) {
+	// Instantiate and unpack pipeline parameters into operation.
+	c := &Composite{}
+	if err := p.Unpack(c); err != nil {
+		return nil, err
+	}
+
+	// Check for required pipeline parameters.
+	if c.Image == "" {
+		return nil, nil
+	}
+
+	if c.Opacity < 0 || c.Opacity > 1 {
+		return nil, fmt.Errorf("composite-opacity: value '%g' is not between 0 and 1", c.Opacity)
+	}
+
+	name, err := base64.RawURLEncoding.DecodeString(c.Image)
+	if err != nil {
+		return nil, fmt.Errorf("composite: unable to decode image name: %s", err)
+	}
+
+	c.name = path.Join("/", string(name))
+	return c, nil
+}
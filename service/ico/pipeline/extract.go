@@ -0,0 +1,79 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "resize.h"
+import "C"
+
+import (
+	// Standard library.
+	"fmt"
+)
+
+// Extract is an operation for extracting a region of an image, as given by the
+// explicit coordinates and dimensions of the region, in pixels. Regions are
+// extracted from the original image, before any resize operation is applied.
+type Extract struct {
+	X      int64 `key:"extract" index:"0" valid:"^[0-9]+$"`
+	Y      int64 `key:"extract" index:"1" valid:"^[0-9]+$"`
+	Width  int64 `key:"extract" index:"2" valid:"^[0-9]+$"`
+	Height int64 `key:"extract" index:"3" valid:"^[0-9]+$"`
+}
+
+// Process extracts the region given from the image provided, changing the data
+// in-place. Returns a LimitError if the region does not lie within the image,
+// or an error if processing fails for any other reason.
+func (e *Extract) Process(handle *Handle) error {
+	img := (*C.ico_image)(handle)
+
+	w, h := handle.Width(), handle.Height()
+	if e.X+e.Width > w || e.Y+e.Height > h {
+		return &LimitError{fmt.Sprintf("region %dx%d at %d:%d lies outside image of size %dx%d", e.Width, e.Height, e.X, e.Y, w, h)}
+	}
+
+	// Do not extract region if region is the same as the image itself.
+	if e.Width == w && e.Height == h {
+		return nil
+	}
+
+	if _, err := C.ico_image_crop(img, C.int(e.X), C.int(e.Y), C.int(e.Width), C.int(e.Height)); err != nil {
+		return fmt.Errorf("failed to extract region: %s", vipsError())
+	}
+
+	// The original image buffer no longer corresponds to the image, and cannot be
+	// used for shrink-on-load operations, which would load the full image instead.
+	img.data.buffer, img.data.len = nil, 0
+
+	img.origin.left += C.int(e.X)
+	img.origin.top += C.int(e.Y)
+
+	return nil
+}
+
+// NewExtract attempts to initialize an extract operation from the parameters
+// provided. The extract parameter is given as 'x:y:width:height', and regions
+// are required to have a positive width and height. The operation is skipped if
+// no parameter is given.
+func NewExtract(p *Params) (Operation, error) {
+	// Instantiate and unpack pipeline parameters into operation.
+	e := &Extract{}
+	if err := p.Unpack(e); err != nil {
+		return nil, err
+	}
+
+	// Check for required pipeline parameters.
+	if _, ok := (*p)["extract"]; !ok {
+		return nil, nil
+	}
+
+	if e.Width == 0 || e.Height == 0 {
+		return nil, fmt.Errorf("extract: region width and height must be positive integers")
+	}
+
+	return e, nil
+}
@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	// Standard library.
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func TestExtractShrink(t *testing.T) {
+	requireSave(t, "png")
+
+	// Shrinking by a factor of 4 would load the original JPEG image at a smaller
+	// size, if the original image buffer were used after extracting the region.
+	p, err := New("extract=0:0:160:120,width=40,format=png")
+	if err != nil {
+		t.Fatalf("New() returned error: %s", err)
+	}
+
+	img := fixture(t, "photo.jpg")
+	if err := p.Process(img); err != nil {
+		t.Fatalf("Process() returned error: %s", err)
+	}
+
+	out, err := png.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		t.Fatalf("failed to decode processed image: %s", err)
+	}
+
+	if b := out.Bounds(); b.Dx() != 40 || b.Dy() != 30 {
+		t.Fatalf("Process() returned image of %dx%d, want 40x30", b.Dx(), b.Dy())
+	}
+
+	// The red component of the fixture increases from left to right, and is only
+	// half of its maximum at the right edge of the region extracted.
+	if r, _, _ := pixelAt(out, 39, 15); r > 160 {
+		t.Errorf("Process() returned red component of %d at right edge, want region extracted from left half", r)
+	}
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+import "C"
+
+import (
+	// Standard library.
+	"fmt"
+	"sort"
+	"unsafe"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// Format represents support for loading and saving images of a specific format,
+// as determined by the operations available in the linked VIPS library.
+type Format struct {
+	Load bool `json:"load"` // Whether images of this format can be loaded.
+	Save bool `json:"save"` // Whether images of this format can be saved.
+}
+
+// A lookup table of image types against the VIPS operations used for loading
+// and saving images of that type. Types with no operation are unsupported. All
+// other information on image types is held in the image package.
+var formatOperations = map[image.Kind][2]string{
+	image.JPEG: {"jpegload_buffer", "jpegsave_buffer"},
+	image.PNG:  {"pngload_buffer", "pngsave_buffer"},
+	image.GIF:  {"gifload_buffer", ""},
+	image.AVIF: {"heifload_buffer", "heifsave_buffer"},
+	image.WEBP: {"webpload_buffer", "webpsave_buffer"},
+	image.HEIF: {"heifload_buffer", ""},
+	image.SVG:  {"svgload_buffer", ""},
+}
+
+// A map of formats supported, indexed under their name.
+var formats = make(map[string]Format)
+
+// Formats returns the list of formats supported by the linked VIPS library,
+// indexed under their name. No formats are returned if the VIPS library failed
+// to initialize.
+func Formats() map[string]Format {
+	Init()
+	return formats
+}
+
+// Returns a sorted list of format names for which saving images is supported by
+// the linked VIPS library.
+func saveFormats() []string {
+	var list []string
+	for name, f := range formats {
+		if f.Save {
+			list = append(list, name)
+		}
+	}
+
+	sort.Strings(list)
+	return list
+}
+
+// Determines formats supported by the linked VIPS library, which may have been
+// built without support for some formats.
+func probeFormats() {
+	for _, k := range image.Kinds() {
+		ops := formatOperations[k]
+		formats[k.Name()] = Format{Load: operationExists(ops[0]), Save: operationExists(ops[1])}
+	}
+}
+
+// Returns the image type for the output format name given, and false if the name
+// does not correspond to a format images can be written in, regardless of support
+// in the linked VIPS library.
+func outputKind(name string) (image.Kind, bool) {
+	k, ok := image.ParseKind(name)
+	if !ok || formatOperations[k][1] == "" {
+		return 0, false
+	}
+
+	return k, true
+}
+
+// Returns an UnsupportedError if loading images of the type provided is not
+// supported by the linked VIPS library, or a DecodeError if the image provided
+// contains no data.
+func checkLoad(img *image.Image) error {
+	if len(img.Data) == 0 || img.Size == 0 {
+		return &DecodeError{fmt.Sprintf("image of type '%s' is empty", img.Type.String())}
+	}
+
+	if !formats[img.Type.Name()].Load {
+		return &UnsupportedError{fmt.Sprintf("loading images of type '%s' is not supported by the linked VIPS library", img.Type.String())}
+	}
+
+	return nil
+}
+
+// Returns true if an operation exists in the linked VIPS library.
+func operationExists(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	n := C.CString(name)
+	defer C.free(unsafe.Pointer(n))
+
+	return C.ico_operation_exists(n) != 0
+}
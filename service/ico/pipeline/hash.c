@@ -0,0 +1,74 @@
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
+#include <vips/vips.h>
+
+#include "pipeline.h"
+#include "hash.h"
+
+void ico_image_hash_pixels(ico_image *img, int size, unsigned char *out) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 5);
+	VipsImage *in = img->internal;
+	void *buf;
+	size_t len;
+
+	// Only the first page is used for images with multiple pages loaded.
+	if (vips_image_get_page_height(in) < vips_image_get_height(in)) {
+		if (vips_extract_area(in, &t[0], 0, 0, vips_image_get_width(in), vips_image_get_page_height(in), NULL) != 0) {
+			g_object_unref(base);
+			errno = 1;
+			return;
+		}
+
+		in = t[0];
+	}
+
+	// Reduce image to a square greyscale image of the requested size, ignoring its aspect ratio.
+	if (vips_thumbnail_image(in, &t[1], size, "height", size, "size", VIPS_SIZE_FORCE, NULL) != 0 ||
+	    vips_colourspace(t[1], &t[2], VIPS_INTERPRETATION_B_W, NULL) != 0) {
+		g_object_unref(base);
+		errno = 1;
+		return;
+	}
+
+	in = t[2];
+
+	// Transparent areas are flattened against a black background.
+	if (vips_image_hasalpha(in)) {
+		if (vips_flatten(in, &t[3], NULL) != 0) {
+			g_object_unref(base);
+			errno = 1;
+			return;
+		}
+
+		in = t[3];
+	}
+
+	if (vips_cast_uchar(in, &t[4], NULL) != 0) {
+		g_object_unref(base);
+		errno = 1;
+		return;
+	}
+
+	buf = vips_image_write_to_memory(t[4], &len);
+	if (buf == NULL) {
+		g_object_unref(base);
+		errno = 1;
+		return;
+	} else if (len != (size_t) size * size) {
+		vips_error("pipeline", "%s", "unexpected size for reduced image");
+		g_free(buf);
+		g_object_unref(base);
+		errno = 1;
+		return;
+	}
+
+	memcpy(out, buf, len);
+
+	g_free(buf);
+	g_object_unref(base);
+
+	errno = 0;
+	return;
+}
@@ -0,0 +1,130 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "hash.h"
+import "C"
+
+import (
+	// Standard library.
+	"fmt"
+	"math"
+	"sort"
+	"unsafe"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// The size of the greyscale image perceptual hashes are computed from, and the
+// size of the block of lowest frequencies hash bits are taken from, which gives
+// a hash of 64 bits.
+const (
+	hashSize  = 32
+	hashBlock = 8
+)
+
+// A table of DCT-II coefficients for the lowest frequencies, scaled for an
+// orthonormal transform, and indexed by frequency and pixel position.
+var hashCosines = func() [hashBlock][hashSize]float64 {
+	var c [hashBlock][hashSize]float64
+	for u := 0; u < hashBlock; u++ {
+		scale := math.Sqrt(2.0 / hashSize)
+		if u == 0 {
+			scale = math.Sqrt(1.0 / hashSize)
+		}
+
+		for x := 0; x < hashSize; x++ {
+			c[u][x] = scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/(2*hashSize))
+		}
+	}
+
+	return c
+}()
+
+// Hash returns the perceptual hash for the image provided, in hexadecimal
+// notation, as described for perceptualHash. The image data is decoded in
+// order to compute the hash, and images processed against a pipeline may have
+// their hash computed while processing instead, by setting Pipeline.Hash.
+func Hash(img *image.Image) (string, error) {
+	if err := Init(); err != nil {
+		return "", err
+	}
+
+	if err := checkLoad(img); err != nil {
+		return "", err
+	}
+
+	ptr, err := C.ico_image_new(unsafe.Pointer(&img.Data[0]), C.size_t(img.Size), C.int(img.Type))
+	if err != nil {
+		return "", decodeError(img)
+	}
+
+	defer C.ico_image_destroy(ptr)
+
+	h, err := perceptualHash(ptr)
+	if err != nil {
+		return "", err
+	}
+
+	return formatHash(h), nil
+}
+
+// Returns a 64-bit perceptual hash for the image provided, which is the same for
+// visually similar images, regardless of their size or format. The image is
+// reduced to a 32x32 greyscale image, for which a two-dimensional DCT is
+// computed. Each bit of the hash corresponds to one of the 8x8 lowest frequency
+// coefficients, in row-major order starting from the most significant bit, and
+// is set if the coefficient is greater than the median of all 64 coefficients.
+func perceptualHash(img *C.ico_image) (uint64, error) {
+	pixels := make([]byte, hashSize*hashSize)
+	if _, err := C.ico_image_hash_pixels(img, C.int(hashSize), (*C.uchar)(unsafe.Pointer(&pixels[0]))); err != nil {
+		return 0, fmt.Errorf("failed to compute hash for image: %s", vipsError())
+	}
+
+	// Transform rows, then columns, computing only the lowest frequencies in each.
+	var rows [hashSize][hashBlock]float64
+	for y := 0; y < hashSize; y++ {
+		for u := 0; u < hashBlock; u++ {
+			for x := 0; x < hashSize; x++ {
+				rows[y][u] += hashCosines[u][x] * float64(pixels[y*hashSize+x])
+			}
+		}
+	}
+
+	coeffs := make([]float64, 0, hashBlock*hashBlock)
+	for v := 0; v < hashBlock; v++ {
+		for u := 0; u < hashBlock; u++ {
+			var sum float64
+			for y := 0; y < hashSize; y++ {
+				sum += hashCosines[v][y] * rows[y][u]
+			}
+
+			coeffs = append(coeffs, sum)
+		}
+	}
+
+	sorted := append([]float64(nil), coeffs...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(len(coeffs)-1-i)
+		}
+	}
+
+	return hash, nil
+}
+
+// Returns the perceptual hash provided in hexadecimal notation, zero-padded to
+// the full length of the hash.
+func formatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
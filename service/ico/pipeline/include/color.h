@@ -0,0 +1,6 @@
+#ifndef __COLOR_H__
+#define __COLOR_H__
+
+void ico_image_color_pixels(ico_image *img, int size, unsigned char *out);
+
+#endif
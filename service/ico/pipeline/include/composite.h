@@ -0,0 +1,6 @@
+#ifndef __COMPOSITE_H__
+#define __COMPOSITE_H__
+
+void ico_image_composite(ico_image *img, ico_image *overlay, int x, int y, double opacity);
+
+#endif
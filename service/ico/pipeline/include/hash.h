@@ -0,0 +1,6 @@
+#ifndef __HASH_H__
+#define __HASH_H__
+
+void ico_image_hash_pixels(ico_image *img, int size, unsigned char *out);
+
+#endif
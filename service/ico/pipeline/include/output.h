@@ -0,0 +1,8 @@
+#ifndef __OUTPUT_H__
+#define __OUTPUT_H__
+
+int ico_image_web_safe(ico_image *img);
+void ico_image_colourspace(ico_image *img);
+void ico_image_strip(ico_image *img);
+
+#endif
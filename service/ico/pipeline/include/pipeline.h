@@ -7,23 +7,53 @@ typedef struct __ico_image {
 		const void *buffer;
 		size_t len;
 	} data;
+	// The offset of the image within the original image, as changed by operations extracting a
+	// region of the image, and the dimensions of the original image.
+	struct {
+		int left, top, width, height;
+	} origin;
 	int type;
+	int output;
+	int quality;
+	int effort;
+	int lossless;
+	int near_lossless;
+	int optimize;
+	int trellis;
+	int strip;
+	volatile int kill;
 } ico_image;
 
+// Image types, which are required to match the values for 'image.Kind'.
 enum {
 	TYPE_JPEG,
 	TYPE_PNG,
 	TYPE_GIF,
+	TYPE_AVIF,
+	TYPE_WEBP,
+	TYPE_HEIF,
+	TYPE_SVG,
 };
 
 int ico_init();
-const char *ico_error();
+char *ico_error();
+int ico_operation_exists(const char *name);
+int ico_loader_exists(const void *data, size_t len);
 
 ico_image *ico_image_new(const void *data, size_t len, int type);
+ico_image *ico_image_copy(ico_image *img);
+void ico_image_decode(ico_image *img);
+void ico_image_load_pages(ico_image *img);
+void ico_image_load_page(ico_image *img, int page);
+ico_image *ico_image_frame(ico_image *img, int page);
+void ico_image_join(ico_image *img, ico_image **frames, int n);
 void ico_image_write(ico_image *img, void **buf, size_t *len);
 void ico_image_destroy(ico_image *img);
+void ico_image_replace(ico_image *img, VipsImage *internal);
+void ico_image_kill(ico_image *img);
 
 int ico_image_width(ico_image *img);
 int ico_image_height(ico_image *img);
+int ico_image_pages(ico_image *img);
 
 #endif
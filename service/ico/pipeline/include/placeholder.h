@@ -0,0 +1,6 @@
+#ifndef __PLACEHOLDER_H__
+#define __PLACEHOLDER_H__
+
+void ico_placeholder(const void *data, size_t len, int size, double sigma, void **buf, size_t *out);
+
+#endif
@@ -1,8 +1,18 @@
 #ifndef __RESIZE_H__
 #define __RESIZE_H__
 
+enum {
+	KERNEL_BILINEAR,
+	KERNEL_NEAREST,
+	KERNEL_BICUBIC,
+	KERNEL_LANCZOS3,
+};
+
+void ico_image_render(ico_image *img, double scale);
 void ico_image_shrink(ico_image *img, double factor);
-void ico_image_affine(ico_image *img, double factor);
+void ico_image_affine(ico_image *img, double xscale, double yscale, int kernel);
 void ico_image_crop(ico_image *img, int x, int y, int w, int h);
+const void *ico_image_xmp(ico_image *img, size_t *len);
+void ico_image_embed(ico_image *img, int x, int y, int w, int h, double r, double g, double b);
 
 #endif
@@ -0,0 +1,14 @@
+#ifndef __TEXT_H__
+#define __TEXT_H__
+
+enum {
+	GRAVITY_CENTER,
+	GRAVITY_TOP,
+	GRAVITY_BOTTOM,
+	GRAVITY_LEFT,
+	GRAVITY_RIGHT,
+};
+
+void ico_image_text(ico_image *img, const char *text, const char *font, const char *fontfile, double r, double g, double b, int gravity);
+
+#endif
@@ -0,0 +1,6 @@
+#ifndef __TINT_H__
+#define __TINT_H__
+
+void ico_image_tint(ico_image *img, const unsigned char *lut);
+
+#endif
@@ -0,0 +1,6 @@
+#ifndef __TRIM_H__
+#define __TRIM_H__
+
+void ico_image_trim(ico_image *img, double threshold);
+
+#endif
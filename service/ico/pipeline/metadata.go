@@ -0,0 +1,187 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "output.h"
+import "C"
+
+import (
+	// Standard library.
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// Returns true if the only change requested by the pipeline for the image given
+// is stripping metadata, in which case metadata may be stripped from the image
+// data directly, without decoding and re-encoding pixel data. This is only the
+// case for JPEG images written as JPEG, with no operation other than the output
+// operation applied, and with no output option affecting pixel data set.
+func (p *Pipeline) metadataOnly(ptr *C.ico_image, img *image.Image) bool {
+	if img.Type != image.JPEG || p.Hash || p.Debug || len(p.operations) != 1 {
+		return false
+	}
+
+	o, ok := p.operations[0].(*Output)
+	if !ok || o.Strip != "true" || (o.Format != "" && o.Format != "jpeg") {
+		return false
+	} else if o.Quality != 0 || o.Optimize == "true" || o.Trellis == "true" {
+		return false
+	}
+
+	// Images are converted to the sRGB colourspace unless the colourspace is kept,
+	// which leaves pixel data unchanged for images already in a web-safe colourspace.
+	return o.Colorspace == "keep" || C.ico_image_web_safe(ptr) != 0
+}
+
+// JPEG markers relevant to stripping metadata.
+const (
+	jpegMarkerSOI  = 0xd8 // Start of image.
+	jpegMarkerSOS  = 0xda // Start of scan, followed by entropy-coded data.
+	jpegMarkerAPP0 = 0xe0 // JFIF header, which is kept.
+	jpegMarkerAPP1 = 0xe1 // EXIF data.
+	jpegMarkerAPP2 = 0xe2 // ICC profile, possibly split across several segments.
+	jpegMarkerAPPF = 0xef // Last application segment.
+	jpegMarkerCOM  = 0xfe // Comment.
+)
+
+// Returns the JPEG image data given with all metadata removed, including EXIF,
+// XMP, IPTC and ICC profile segments, as well as comments. Segments are copied
+// as-is otherwise, and pixel data is left unchanged. If keep is set, metadata
+// affecting how the image is displayed is kept, i.e. ICC profile segments, and
+// the EXIF orientation for images with an orientation other than the default,
+// which is written as an EXIF segment of its own. Returns an error if the image
+// data is malformed.
+func stripJPEG(data []byte, keep bool) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegMarkerSOI {
+		return nil, fmt.Errorf("missing start of image marker")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(data[:2])
+
+	for i := 2; i < len(data); {
+		if data[i] != 0xff {
+			return nil, fmt.Errorf("expected marker at offset %d", i)
+		}
+
+		// Markers may be preceded by any number of fill bytes.
+		start := i
+		for i < len(data) && data[i] == 0xff {
+			i++
+		}
+
+		if i >= len(data) {
+			return nil, fmt.Errorf("unexpected end of data at offset %d", start)
+		}
+
+		marker := data[i]
+		i++
+
+		// Standalone markers carry no segment data.
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			buf.Write(data[start:i])
+			continue
+		}
+
+		if i+2 > len(data) {
+			return nil, fmt.Errorf("unexpected end of data at offset %d", i)
+		}
+
+		end := i + (int(data[i])<<8 | int(data[i+1]))
+		if end > len(data) || end < i+2 {
+			return nil, fmt.Errorf("invalid segment length at offset %d", i)
+		}
+
+		// Entropy-coded data following the start of scan is copied as-is, along
+		// with any segments following it.
+		if marker == jpegMarkerSOS {
+			buf.Write(data[start:])
+			break
+		}
+
+		if keep && marker == jpegMarkerAPP2 && bytes.HasPrefix(data[i+2:end], []byte("ICC_PROFILE\x00")) {
+			buf.Write(data[start:end])
+			i = end
+			continue
+		} else if keep && marker == jpegMarkerAPP1 {
+			if o := exifOrientation(data[i+2 : end]); o > 1 {
+				buf.Write(orientationSegment(o))
+			}
+		}
+
+		if marker == jpegMarkerCOM || (marker > jpegMarkerAPP0 && marker <= jpegMarkerAPPF) {
+			i = end
+			continue
+		}
+
+		buf.Write(data[start:end])
+		i = end
+	}
+
+	return buf.Bytes(), nil
+}
+
+// The EXIF tag for image orientation.
+const exifTagOrientation = 0x0112
+
+// Returns the orientation stored in the EXIF segment data given, from 1 to 8, or
+// zero if the segment data is not EXIF data or does not contain an orientation.
+func exifOrientation(seg []byte) int {
+	if !bytes.HasPrefix(seg, []byte("Exif\x00\x00")) || len(seg) < 14 {
+		return 0
+	}
+
+	// Offsets are relative to the TIFF header following the EXIF identifier.
+	tiff := seg[6:]
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+
+	n := int(order.Uint16(tiff[offset:]))
+	for i := offset + 2; i+12 <= len(tiff) && n > 0; i, n = i+12, n-1 {
+		if order.Uint16(tiff[i:]) != exifTagOrientation {
+			continue
+		}
+
+		if o := int(order.Uint16(tiff[i+8:])); o >= 1 && o <= 8 {
+			return o
+		}
+
+		break
+	}
+
+	return 0
+}
+
+// Returns a JPEG EXIF segment containing only the orientation given.
+func orientationSegment(o int) []byte {
+	return []byte{
+		0xff, jpegMarkerAPP1, 0x00, 0x22, // Marker and segment length.
+		'E', 'x', 'i', 'f', 0x00, 0x00, // EXIF identifier.
+		'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08, // TIFF header, big-endian.
+		0x00, 0x01, // Number of entries in first directory.
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, byte(o), 0x00, 0x00, // Orientation, as a single short.
+		0x00, 0x00, 0x00, 0x00, // Offset of next directory.
+	}
+}
@@ -0,0 +1,73 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+import "C"
+
+import (
+	// Standard library.
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// Re-encodes the image provided losslessly in its original format, with metadata
+// removed other than the ICC profile and any orientation other than the default,
+// and at the highest compression level supported, for pipelines with the
+// 'optimize=lossless' parameter. JPEG images have metadata removed directly, as
+// re-encoding would lose quality, while PNG and lossless WebP images are decoded
+// and re-encoded. Images in other formats, and lossy WebP images, are left as-is.
+// The original image data is kept if re-encoding does not reduce its size.
+func (p *Pipeline) optimizeLossless(ctx context.Context, ptr *C.ico_image, img *image.Image) error {
+	if len(p.operations) != 1 {
+		return &LimitError{"optimize: value 'lossless' cannot be combined with other operations"}
+	}
+
+	data, size, kind := img.Data, img.Size, img.Type
+	switch {
+	case img.Type == image.JPEG:
+		stripped, err := stripJPEG(img.Data, true)
+		if err != nil {
+			return &DecodeError{fmt.Sprintf("failed to optimize image of type '%s': %s", img.Type.String(), err)}
+		}
+
+		img.Data, img.Size = stripped, int64(len(stripped))
+	case img.Type == image.PNG || (img.Type == image.WEBP && losslessWebP(img.Data)):
+		if err := p.process(ctx, ptr, img); err != nil {
+			return err
+		}
+	}
+
+	if img.Size >= size {
+		img.Data, img.Size, img.Type = data, size, kind
+	}
+
+	return nil
+}
+
+// Returns true if the WebP image data given is compressed losslessly, i.e. if its
+// image data is stored in a 'VP8L' chunk. Animated images are never considered to
+// be compressed losslessly, as their frames are stored in nested chunks.
+func losslessWebP(data []byte) bool {
+	for i := 12; i+8 <= len(data); {
+		switch string(data[i : i+4]) {
+		case "VP8L":
+			return true
+		case "VP8 ", "ANMF":
+			return false
+		}
+
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		i += 8 + size + size%2
+	}
+
+	return false
+}
@@ -0,0 +1,76 @@
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
+#include <vips/vips.h>
+
+#include "pipeline.h"
+#include "output.h"
+
+int ico_image_web_safe(ico_image *img) {
+	VipsInterpretation space = vips_image_guess_interpretation(img->internal);
+	return space == VIPS_INTERPRETATION_sRGB || space == VIPS_INTERPRETATION_B_W;
+}
+
+void ico_image_colourspace(ico_image *img) {
+	VipsImage *tmp = NULL;
+	VipsInterpretation space = vips_image_guess_interpretation(img->internal);
+
+	// Return without converting if image is already in a web-safe colourspace.
+	if (ico_image_web_safe(img)) {
+		errno = 0;
+		return;
+	}
+
+	// CMYK images require an ICC-aware transform for correct colours, using the embedded profile
+	// if available, and falling back to a generic CMYK profile otherwise.
+	if (space == VIPS_INTERPRETATION_CMYK) {
+		if (vips_icc_transform(img->internal, &tmp, "srgb", "input_profile", "cmyk", "embedded", 1, NULL) != 0) {
+			errno = 1;
+			return;
+		}
+	} else if (vips_colourspace(img->internal, &tmp, VIPS_INTERPRETATION_sRGB, NULL) != 0) {
+		errno = 1;
+		return;
+	}
+
+	g_object_unref(img->internal);
+	img->internal = tmp;
+
+	errno = 0;
+	return;
+}
+
+void ico_image_strip(ico_image *img) {
+	VipsImage *tmp = NULL;
+	gchar **fields;
+	int orientation = 1, i;
+
+	if (vips_copy(img->internal, &tmp, NULL) != 0) {
+		errno = 1;
+		return;
+	}
+
+	// EXIF data is kept for images with an orientation other than the default, as images would
+	// otherwise be displayed rotated or flipped. The ICC profile is always kept.
+	if (vips_image_get_typeof(tmp, VIPS_META_ORIENTATION) != 0) {
+		vips_image_get_int(tmp, VIPS_META_ORIENTATION, &orientation);
+	}
+
+	fields = vips_image_get_fields(tmp);
+	for (i = 0; fields[i] != NULL; i++) {
+		if (strcmp(fields[i], VIPS_META_EXIF_NAME) == 0 && orientation == 1) {
+			vips_image_remove(tmp, fields[i]);
+		} else if (strcmp(fields[i], VIPS_META_XMP_NAME) == 0 || strcmp(fields[i], VIPS_META_IPTC_NAME) == 0) {
+			vips_image_remove(tmp, fields[i]);
+		} else if (strcmp(fields[i], "photoshop-data") == 0 || g_str_has_prefix(fields[i], "png-comment-")) {
+			vips_image_remove(tmp, fields[i]);
+		}
+	}
+
+	g_strfreev(fields);
+	g_object_unref(img->internal);
+	img->internal = tmp;
+
+	errno = 0;
+	return;
+}
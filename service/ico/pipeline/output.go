@@ -0,0 +1,289 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "output.h"
+// #include "color.h"
+import "C"
+
+import (
+	// Standard library.
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// Output is an operation for preparing images for output, and is applied after
+// all other operations in the pipeline.
+type Output struct {
+	Format       string `key:"format" valid:"^(jpeg|png|avif|webp|auto)$"`
+	Quality      int64  `key:"quality"`
+	Colorspace   string `key:"colorspace" default:"srgb" valid:"^(srgb|keep)$"`
+	Effort       int64  `key:"effort" default:"-1"`
+	Lossless     string `key:"lossless" default:"false" valid:"^(true|false)$"`
+	NearLossless int64  `key:"nearlossless"`
+	Optimize     string `key:"optimize" default:"false" valid:"^(true|false|lossless)$"`
+	Trellis      string `key:"trellis" default:"false" valid:"^(true|false)$"`
+	Strip        string `key:"strip" default:"false" valid:"^(true|false)$"`
+}
+
+// A lookup table of output format names against the maximum encoder effort
+// supported. Formats with no maximum effort do not support setting the effort,
+// or lossless compression.
+var outputEffortLookup = map[string]int64{
+	"avif": 9,
+	"webp": 6,
+}
+
+// Qualities represents qualities for output formats, indexed under the format
+// name. Qualities can be set from configuration as a comma-separated list of
+// format names and qualities, e.g. 'jpeg:75,webp:80'.
+type Qualities map[string]int64
+
+// The default quality for output formats, as set via SetDefaultQuality.
+var defaultQuality atomic.Value
+
+// SetDefaultQuality sets the default quality for output formats, applied for
+// images processed without an explicit quality. Formats with no default quality
+// set use a built-in default, which is 75 for JPEG and WebP, and 50 for AVIF.
+// Default qualities may be changed while pipelines are being processed, and the
+// qualities given must not be modified afterwards.
+func SetDefaultQuality(q Qualities) {
+	defaultQuality.Store(q)
+}
+
+// Set parses qualities from the value provided, and is used for setting default
+// qualities from configuration.
+func (q *Qualities) Set(value string) error {
+	result := make(Qualities)
+	for _, f := range strings.Split(value, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+
+		o := strings.SplitN(f, ":", 2)
+		if len(o) < 2 {
+			return fmt.Errorf("unable to parse malformed quality '%s'", f)
+		}
+
+		if _, ok := outputKind(o[0]); !ok {
+			return fmt.Errorf("unknown output format '%s'", o[0])
+		}
+
+		quality, err := strconv.ParseInt(o[1], 10, 64)
+		if err != nil || quality < 1 || quality > 100 {
+			return fmt.Errorf("quality '%s' for format '%s' is not between 1 and 100", o[1], o[0])
+		}
+
+		result[o[0]] = quality
+	}
+
+	*q = result
+	return nil
+}
+
+// String returns the qualities as a comma-separated list, sorted by format name.
+func (q *Qualities) String() string {
+	var list []string
+	for name, quality := range *q {
+		list = append(list, name+":"+strconv.FormatInt(quality, 10))
+	}
+
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// Process prepares the image provided for output, changing the data in-place.
+// Returns an error if processing fails for any reason.
+func (o *Output) Process(handle *Handle) error {
+	img := (*C.ico_image)(handle)
+
+	// Images optimized losslessly keep their colourspace and format, and are
+	// written with metadata removed at the highest compression level supported.
+	// The ICC profile, and EXIF data for images with an orientation other than
+	// the default, are kept, as removing these would change how images display.
+	if o.Optimize == "lossless" {
+		if _, err := C.ico_image_strip(img); err != nil {
+			return fmt.Errorf("failed to remove metadata from image: %s", vipsError())
+		}
+
+		img.effort, img.lossless, img.near_lossless = C.int(outputEffortLookup["webp"]), 1, 0
+		img.optimize, img.trellis, img.strip = 1, 0, 0
+		return nil
+	}
+
+	// Convert image to the sRGB colourspace, unless the original colourspace is
+	// to be kept.
+	if o.Colorspace == "srgb" {
+		if _, err := C.ico_image_colourspace(img); err != nil {
+			return fmt.Errorf("failed to convert image to sRGB colourspace: %s", vipsError())
+		}
+	}
+
+	// Set output format and quality for image, if any were requested, falling
+	// back to the default quality for the output format otherwise. Formats are
+	// chosen from the image contents when automatic selection is requested.
+	var autoLossless bool
+	if o.Format == "auto" {
+		k, lossless, err := autoFormat(img)
+		if err != nil {
+			return err
+		}
+
+		img.output, autoLossless = C.int(k), lossless
+	} else if k, ok := outputKind(o.Format); ok {
+		img.output = C.int(k)
+	}
+
+	output := image.Kind(img.output)
+
+	img.quality = C.int(o.Quality)
+	if o.Quality == 0 {
+		q, _ := defaultQuality.Load().(Qualities)
+		img.quality = C.int(q[output.Name()])
+	}
+
+	// Set encoder effort and lossless compression, which only apply to formats
+	// supporting them. Effort is limited to the maximum for the output format, as
+	// the output format may not be known until the image is processed.
+	img.effort, img.lossless = C.int(o.Effort), 0
+	if max := outputEffortLookup[output.Name()]; o.Effort > max {
+		img.effort = C.int(max)
+	}
+
+	if o.Lossless == "true" || autoLossless {
+		img.lossless = 1
+	}
+
+	// Set near-lossless compression level, which only applies to WebP images.
+	img.near_lossless = C.int(o.NearLossless)
+
+	// Set JPEG encoder options, which are ignored for other formats.
+	img.optimize, img.trellis = 0, 0
+	if o.Optimize == "true" && output == image.JPEG {
+		img.optimize = 1
+	}
+
+	if o.Trellis == "true" {
+		img.trellis = 1
+	}
+
+	img.strip = 0
+	if o.Strip == "true" {
+		img.strip = 1
+	}
+
+	return nil
+}
+
+// The maximum number of distinct colors found in images considered to be flat
+// graphics, such as logos or screenshots, when selecting formats automatically.
+const autoFormatColors = 256
+
+// Returns the output format for images requested with automatic format selection,
+// and whether the image is to be compressed losslessly. Images are reduced to a
+// 64x64 sRGB image, as for imageColor, and images with few distinct colors are
+// considered flat graphics, which are saved as lossless WebP, or PNG if WebP is
+// not supported. Other images are considered photographic, and are saved as lossy
+// WebP, or JPEG if WebP is not supported, or PNG if the image has transparency.
+func autoFormat(img *C.ico_image) (image.Kind, bool, error) {
+	pixels := make([]byte, colorSize*colorSize*4)
+	if _, err := C.ico_image_color_pixels(img, C.int(colorSize), (*C.uchar)(unsafe.Pointer(&pixels[0]))); err != nil {
+		return 0, false, fmt.Errorf("failed to select output format for image: %s", vipsError())
+	}
+
+	var alpha bool
+	colors := make(map[uint32]bool)
+	for i := 0; i < len(pixels); i += 4 {
+		colors[uint32(pixels[i])<<24|uint32(pixels[i+1])<<16|uint32(pixels[i+2])<<8|uint32(pixels[i+3])] = true
+		alpha = alpha || pixels[i+3] < 255
+	}
+
+	webp := formats["webp"].Save
+	name, lossless := "jpeg", false
+	switch {
+	case len(colors) <= autoFormatColors && webp:
+		name, lossless = "webp", true
+	case len(colors) <= autoFormatColors || (alpha && !webp):
+		name = "png"
+	case webp:
+		name = "webp"
+	}
+
+	k, _ := outputKind(name)
+	return k, lossless, nil
+}
+
+// Returns true if the output format supports animation, in which case all frames
+// of animated images are processed.
+func (o *Output) animated() bool {
+	return o.Format == "webp"
+}
+
+// NewOutput initializes an output operation from the parameters provided. The
+// output operation is applied for all pipelines.
+func NewOutput(p *Params) (Operation, error) {
+	// Instantiate and unpack pipeline parameters into operation.
+	o := &Output{}
+	if err := p.Unpack(o); err != nil {
+		return nil, err
+	}
+
+	if o.Format != "" && o.Format != "auto" && !formats[o.Format].Save {
+		return nil, fmt.Errorf("format: output format '%s' is not supported, use one of: %s", o.Format, strings.Join(saveFormats(), ", "))
+	}
+
+	if o.Quality < 0 || o.Quality > 100 {
+		return nil, fmt.Errorf("quality: value '%d' is not between 1 and 100", o.Quality)
+	}
+
+	// Check encoder effort against the maximum for the output format, if known,
+	// or the maximum for any format otherwise.
+	if o.Effort != -1 {
+		max, ok := outputEffortLookup[o.Format]
+		if o.Format == "" || o.Format == "auto" {
+			max, ok = outputEffortLookup["avif"], true
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("effort: not supported for output format '%s'", o.Format)
+		} else if o.Effort < 0 || o.Effort > max {
+			return nil, fmt.Errorf("effort: value '%d' is not between 0 and %d", o.Effort, max)
+		}
+	}
+
+	if _, ok := outputEffortLookup[o.Format]; o.Lossless == "true" && o.Format != "" && o.Format != "auto" && !ok {
+		return nil, fmt.Errorf("lossless: not supported for output format '%s'", o.Format)
+	}
+
+	if o.NearLossless < 0 || o.NearLossless > 100 {
+		return nil, fmt.Errorf("nearlossless: value '%d' is not between 1 and 100", o.NearLossless)
+	} else if o.NearLossless > 0 && o.Format != "" && o.Format != "auto" && o.Format != "webp" {
+		return nil, fmt.Errorf("nearlossless: not supported for output format '%s'", o.Format)
+	}
+
+	if o.Optimize == "lossless" {
+		if o.Format != "" || o.Quality != 0 || o.Effort != -1 || o.Lossless == "true" || o.NearLossless != 0 || o.Trellis == "true" {
+			return nil, fmt.Errorf("optimize: value 'lossless' cannot be combined with format, quality or encoder options")
+		}
+	} else if o.Format != "" && o.Format != "auto" && o.Format != "jpeg" {
+		if o.Optimize == "true" {
+			return nil, fmt.Errorf("optimize: not supported for output format '%s'", o.Format)
+		} else if o.Trellis == "true" {
+			return nil, fmt.Errorf("trellis: not supported for output format '%s'", o.Format)
+		}
+	}
+
+	return o, nil
+}
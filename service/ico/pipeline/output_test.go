@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	// Standard library.
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// Returns the red, green and blue components for the pixel at the coordinates
+// given in the image provided, as 8-bit values.
+func pixelAt(img image.Image, x, y int) (r, g, b uint32) {
+	r, g, b, _ = img.At(x, y).RGBA()
+	return r >> 8, g >> 8, b >> 8
+}
+
+func TestOutputCMYK(t *testing.T) {
+	if !operationExists("icc_transform") {
+		t.Skip("ICC transforms are not supported by the linked VIPS library")
+	}
+
+	p, err := New("")
+	if err != nil {
+		t.Fatalf("New(\"\") returned error: %s", err)
+	}
+
+	// The fixture is an Adobe CMYK image, stored with inverted values, and split
+	// into quadrants of full cyan, magenta, yellow and black ink, in turn.
+	img := fixture(t, "cmyk.jpg")
+	if err := p.Process(img); err != nil {
+		t.Fatalf("Process() returned error: %s", err)
+	}
+
+	out, err := jpeg.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		t.Fatalf("failed to decode processed image: %s", err)
+	}
+
+	// Colors depend on the profile used for conversion, and are only checked to
+	// be in the right range, which fails for images converted without an ICC
+	// transform, or with their values inverted.
+	tests := []struct {
+		name string
+		x, y int
+		want func(r, g, b uint32) bool
+	}{
+		{"cyan", 16, 16, func(r, g, b uint32) bool { return r < 100 && g > 100 && b > 180 }},
+		{"magenta", 48, 16, func(r, g, b uint32) bool { return r > 180 && g < 100 && b > 60 }},
+		{"yellow", 16, 48, func(r, g, b uint32) bool { return r > 200 && g > 200 && b < 100 }},
+		{"black", 48, 48, func(r, g, b uint32) bool { return r < 90 && g < 90 && b < 90 }},
+	}
+
+	for _, tt := range tests {
+		if r, g, b := pixelAt(out, tt.x, tt.y); !tt.want(r, g, b) {
+			t.Errorf("Process() converted %s ink to RGB color (%d, %d, %d)", tt.name, r, g, b)
+		}
+	}
+}
+
+func TestOutputOptimizeJPEG(t *testing.T) {
+	requireSave(t, "jpeg")
+
+	// Optimized Huffman coding and trellis quantization only change how image data
+	// is encoded, and are compared against images written without either.
+	sizes := make(map[string]int64)
+	for _, params := range []string{"format=jpeg", "format=jpeg,optimize=true", "format=jpeg,optimize=true,trellis=true"} {
+		p, err := New(params)
+		if err != nil {
+			t.Fatalf("New(%q) returned error: %s", params, err)
+		}
+
+		img := fixture(t, "photo.jpg")
+		if err := p.Process(img); err != nil {
+			t.Fatalf("Process() for %q returned error: %s", params, err)
+		}
+
+		out, err := jpeg.Decode(bytes.NewReader(img.Data))
+		if err != nil {
+			t.Fatalf("Process() for %q returned invalid JPEG image: %s", params, err)
+		}
+
+		if b := out.Bounds(); b.Dx() != 320 || b.Dy() != 240 {
+			t.Errorf("Process() for %q returned image of %dx%d, want 320x240", params, b.Dx(), b.Dy())
+		}
+
+		sizes[params] = img.Size
+	}
+
+	if plain, optimized := sizes["format=jpeg"], sizes["format=jpeg,optimize=true"]; optimized > plain {
+		t.Errorf("Process() with optimized Huffman coding returned %d bytes, more than %d bytes without", optimized, plain)
+	}
+}
+
+func TestOutputQualityPNG(t *testing.T) {
+	requireSave(t, "png")
+
+	// PNG images are compressed losslessly at a fixed level, and are written the
+	// same for all qualities, including those at the edges of the range allowed.
+	var want []byte
+	for _, params := range []string{"format=png", "format=png,quality=1", "format=png,quality=9", "format=png,quality=10", "format=png,quality=11", "format=png,quality=99", "format=png,quality=100"} {
+		p, err := New(params)
+		if err != nil {
+			t.Fatalf("New(%q) returned error: %s", params, err)
+		}
+
+		img := fixture(t, "photo.jpg")
+		if err := p.Process(img); err != nil {
+			t.Fatalf("Process() for %q returned error: %s", params, err)
+		}
+
+		if _, err := png.Decode(bytes.NewReader(img.Data)); err != nil {
+			t.Fatalf("Process() for %q returned invalid PNG image: %s", params, err)
+		}
+
+		if want == nil {
+			want = img.Data
+		} else if !bytes.Equal(img.Data, want) {
+			t.Errorf("Process() for %q returned %d bytes, want same image of %d bytes as without quality", params, img.Size, len(want))
+		}
+	}
+
+	for _, params := range []string{"format=png,quality=-1", "format=png,quality=101"} {
+		if _, err := New(params); err == nil {
+			t.Errorf("New(%q) succeeded, want error", params)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package pipeline
+
+import (
+	// Standard library.
+	"fmt"
+)
+
+// Page is an operation for selecting a single page of multi-page images, such as
+// animated images, for processing. Pages are selected while loading the image,
+// and are numbered starting from zero, which is the page processed by default.
+type Page struct {
+	Page int64 `key:"page"`
+}
+
+// Process leaves the image provided unchanged, as the page is selected while the
+// image is loaded, before any operation is processed.
+func (pg *Page) Process(handle *Handle) error {
+	return nil
+}
+
+// NewPage attempts to initialize a page operation from the parameters provided.
+// The operation is skipped if no page, or the first page, is selected.
+func NewPage(p *Params) (Operation, error) {
+	// Instantiate and unpack pipeline parameters into operation.
+	pg := &Page{}
+	if err := p.Unpack(pg); err != nil {
+		return nil, err
+	}
+
+	if pg.Page < 0 {
+		return nil, fmt.Errorf("page: value '%d' is not a positive integer", pg.Page)
+	} else if pg.Page == 0 {
+		return nil, nil
+	}
+
+	return pg, nil
+}
@@ -137,6 +137,13 @@ func (p *Params) getFieldValue(f *reflect.Value, t reflect.StructTag) (string, e
 	return val, nil
 }
 
+// Returns the red, green and blue components for a color in hexadecimal RGB
+// notation, e.g. 'ff0000'. Invalid colors are treated as black.
+func parseColor(color string) (int64, int64, int64) {
+	c, _ := strconv.ParseInt(color, 16, 64)
+	return (c >> 16) & 0xff, (c >> 8) & 0xff, c & 0xff
+}
+
 // Parse slices the parameter string provided and returns a Params instance,
 // allowing for processing on individual parameters. Returns an error if parsing
 // fails for any reason.
@@ -17,8 +17,31 @@ int ico_init() {
 	return 0;
 }
 
-const char *ico_error() {
-	return vips_error_buffer();
+// Guards taking errors from the error buffer, which is shared between all threads.
+static GMutex error_lock;
+
+// Returns a copy of the errors reported by the VIPS library since the last call,
+// and clears the error buffer, so that errors are only returned to a single
+// caller. The copy returned is owned by the caller, and is to be freed via g_free.
+char *ico_error() {
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9)
+	return vips_error_buffer_copy();
+#else
+	g_mutex_lock(&error_lock);
+	char *msg = g_strdup(vips_error_buffer());
+	vips_error_clear();
+	g_mutex_unlock(&error_lock);
+
+	return msg;
+#endif
+}
+
+int ico_operation_exists(const char *name) {
+	return vips_type_find("VipsOperation", name) != 0;
+}
+
+int ico_loader_exists(const void *data, size_t len) {
+	return vips_foreign_find_load_buffer(data, len) != NULL;
 }
 
 ico_image *ico_image_new(const void *data, size_t len, int type) {
@@ -35,6 +58,7 @@ ico_image *ico_image_new(const void *data, size_t len, int type) {
 	// Attempt to load internal representation of image from buffer via VIPS.
 	img->internal = vips_image_new_from_buffer(data, len, "", NULL);
 	if (img->internal == NULL) {
+		free(img);
 		errno = 1;
 		return NULL;
 	}
@@ -42,28 +66,307 @@ ico_image *ico_image_new(const void *data, size_t len, int type) {
 	img->data.buffer = data;
 	img->data.len = len;
 	img->type = type;
+	img->output = type;
+
+	// Saving to HEIF is not supported, and HEIF images are written as JPEG by default.
+	if (type == TYPE_HEIF) {
+		img->output = TYPE_JPEG;
+	}
+
+	img->quality = 0;
+	img->effort = -1;
+	img->lossless = 0;
+	img->near_lossless = 0;
+	img->optimize = 0;
+	img->trellis = 0;
+	img->strip = 0;
+	img->kill = 0;
+
+	img->origin.left = 0;
+	img->origin.top = 0;
+	img->origin.width = vips_image_get_width(img->internal);
+	img->origin.height = vips_image_get_height(img->internal);
 
 	errno = 0;
 	return img;
 }
 
+ico_image *ico_image_copy(ico_image *img) {
+	ico_image *copy;
+
+	copy = malloc(sizeof(ico_image));
+	if (copy == NULL) {
+		vips_error("pipeline", "%s", "failed to allocate memory for Ico image");
+		errno = 1;
+		return NULL;
+	}
+
+	// VIPS images are immutable, and operations on the copy replace its internal representation, so
+	// the internal representation can be shared between copies.
+	*copy = *img;
+	copy->kill = 0;
+	g_object_ref(copy->internal);
+
+	// Clear any kill flag set on the shared internal representation while processing a copy.
+	vips_image_set_kill(copy->internal, FALSE);
+
+	errno = 0;
+	return copy;
+}
+
+void ico_image_decode(ico_image *img) {
+	VipsImage *mem;
+
+	// Decode image into memory, which allows for processing the image multiple times without having
+	// to decode it again.
+	mem = vips_image_copy_memory(img->internal);
+	if (mem == NULL) {
+		errno = 1;
+		return;
+	}
+
+	ico_image_replace(img, mem);
+
+	errno = 0;
+	return;
+}
+
+void ico_image_load_pages(ico_image *img) {
+	VipsImage *tmp;
+
+	// Only the first page is loaded by default, and all pages need to be loaded from the original buffer.
+	if (img->data.buffer == NULL) {
+		vips_error("pipeline", "%s", "original buffer no longer available for loading pages");
+		errno = 1;
+		return;
+	}
+
+	tmp = vips_image_new_from_buffer(img->data.buffer, img->data.len, "", "n", -1, NULL);
+	if (tmp == NULL) {
+		errno = 1;
+		return;
+	}
+
+	g_object_unref(img->internal);
+	img->internal = tmp;
+
+	errno = 0;
+	return;
+}
+
+void ico_image_load_page(ico_image *img, int page) {
+	VipsImage *tmp;
+
+	// Only the first page is loaded by default, and other pages need to be loaded from the original buffer.
+	if (img->data.buffer == NULL) {
+		vips_error("pipeline", "%s", "original buffer no longer available for loading pages");
+		errno = 1;
+		return;
+	}
+
+	tmp = vips_image_new_from_buffer(img->data.buffer, img->data.len, "", "page", page, NULL);
+	if (tmp == NULL) {
+		errno = 1;
+		return;
+	}
+
+	// The image loaded only contains the page requested, and no longer corresponds to the original
+	// buffer, which would otherwise be used for loading all pages of animated images.
+	ico_image_replace(img, tmp);
+
+	img->origin.width = vips_image_get_width(img->internal);
+	img->origin.height = vips_image_get_height(img->internal);
+
+	errno = 0;
+	return;
+}
+
+ico_image *ico_image_frame(ico_image *img, int page) {
+	ico_image *frame;
+	VipsImage *tmp = NULL;
+	int width = vips_image_get_width(img->internal);
+	int height = vips_image_get_page_height(img->internal);
+
+	frame = ico_image_copy(img);
+	if (frame == NULL) {
+		return NULL;
+	}
+
+	// Pages are stacked vertically in images with all pages loaded.
+	if (vips_extract_area(img->internal, &tmp, 0, page * height, width, height, NULL) != 0) {
+		ico_image_destroy(frame);
+		errno = 1;
+		return NULL;
+	}
+
+	ico_image_replace(frame, tmp);
+
+	errno = 0;
+	return frame;
+}
+
+void ico_image_join(ico_image *img, ico_image **frames, int n) {
+	VipsImage **in, *joined = NULL, *tmp = NULL;
+	int width = vips_image_get_width(frames[0]->internal);
+	int height = vips_image_get_height(frames[0]->internal);
+	int i;
+
+	in = malloc(n * sizeof(VipsImage *));
+	if (in == NULL) {
+		vips_error("pipeline", "%s", "failed to allocate memory for frames");
+		errno = 1;
+		return;
+	}
+
+	// Frames can only be joined if they are all of the same size.
+	for (i = 0; i < n; i++) {
+		if (vips_image_get_width(frames[i]->internal) != width || vips_image_get_height(frames[i]->internal) != height) {
+			vips_error("pipeline", "%s", "frames differ in size after processing");
+			free(in);
+			errno = 1;
+			return;
+		}
+
+		in[i] = frames[i]->internal;
+	}
+
+	if (vips_arrayjoin(in, &joined, n, "across", 1, NULL) != 0) {
+		free(in);
+		errno = 1;
+		return;
+	}
+
+	free(in);
+
+	// Set page height for joined image on a copy, as metadata is shared with the frames.
+	if (vips_copy(joined, &tmp, NULL) != 0) {
+		g_object_unref(joined);
+		errno = 1;
+		return;
+	}
+
+	g_object_unref(joined);
+	vips_image_set_int(tmp, "page-height", height);
+
+	ico_image_replace(img, tmp);
+	img->output = frames[0]->output;
+	img->quality = frames[0]->quality;
+	img->effort = frames[0]->effort;
+	img->lossless = frames[0]->lossless;
+	img->near_lossless = frames[0]->near_lossless;
+	img->optimize = frames[0]->optimize;
+	img->trellis = frames[0]->trellis;
+	img->strip = frames[0]->strip;
+
+	errno = 0;
+	return;
+}
+
+static void ico_image_eval(VipsImage *image, VipsProgress *progress, ico_image *img) {
+	// Stop evaluation of image if processing has been cancelled.
+	if (g_atomic_int_get(&img->kill)) {
+		vips_image_set_kill(image, TRUE);
+	}
+}
+
+void ico_image_kill(ico_image *img) {
+	g_atomic_int_set(&img->kill, 1);
+}
+
 void ico_image_write(ico_image *img, void **buf, size_t *len) {
 	int result;
+	unsigned long handler;
+
+	// Watch evaluation progress for image, which allows for cancelling processing. Only evaluation
+	// while writing the image is watched, and operations evaluating images eagerly beforehand, such
+	// as 'vips_find_trim' or decoding the image into memory, run to completion when cancelled.
+	vips_image_set_progress(img->internal, TRUE);
+	handler = g_signal_connect(img->internal, "eval", G_CALLBACK(ico_image_eval), img);
 
 	// Determine image type to write.
-	switch (img->type) {
+	switch (img->output) {
 	case TYPE_JPEG:
-		result = vips_jpegsave_buffer(img->internal, buf, len, NULL);
+		// Quality, optimized Huffman coding and trellis quantization default to the libvips defaults,
+		// unless set. Trellis quantization requires libvips to have been built against mozjpeg, and
+		// is ignored otherwise.
+		result = vips_jpegsave_buffer(img->internal, buf, len,
+			"Q", img->quality > 0 ? img->quality : 75,
+			"optimize_coding", img->optimize,
+			"trellis_quant", img->trellis,
+			"strip", img->strip, NULL);
+
 		break;
 	case TYPE_PNG:
-		result = vips_pngsave_buffer(img->internal, buf, len, NULL);
+		// PNG compression is lossless, and is set independently of the quality requested, which only
+		// applies to lossy formats. Images optimized losslessly are written at the highest compression
+		// level, trying all filters for each row.
+		if (img->optimize) {
+			result = vips_pngsave_buffer(img->internal, buf, len,
+				"compression", 9,
+				"filter", VIPS_FOREIGN_PNG_FILTER_ALL,
+				"strip", img->strip, NULL);
+		} else {
+			result = vips_pngsave_buffer(img->internal, buf, len, "compression", 6, "strip", img->strip, NULL);
+		}
+
 		break;
-	case TYPE_GIF:
+	case TYPE_AVIF:
+		// AVIF support depends on libvips having been built with HEIF support.
+		if (vips_type_find("VipsOperation", "heifsave_buffer") == 0) {
+			vips_error("pipeline", "%s", "AVIF output is not supported by libvips");
+			result = -1;
+			break;
+		}
+
+		// Encoder effort and lossless compression default to the libvips defaults, unless set. The
+		// 'effort' option is only passed if set, as versions of libvips before 8.12 do not support it.
+		if (img->effort >= 0) {
+			result = vips_heifsave_buffer(img->internal, buf, len,
+				"compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1,
+				"Q", img->quality > 0 ? img->quality : 50,
+				"effort", img->effort,
+				"lossless", img->lossless,
+				"strip", img->strip, NULL);
+		} else {
+			result = vips_heifsave_buffer(img->internal, buf, len,
+				"compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1,
+				"Q", img->quality > 0 ? img->quality : 50,
+				"lossless", img->lossless,
+				"strip", img->strip, NULL);
+		}
+
+		break;
+	case TYPE_WEBP:
+		// Images with multiple pages loaded are saved as animated images. Quality, encoder effort and
+		// lossless compression default to the libvips defaults, unless set. Near-lossless compression
+		// is lossless compression with preprocessing, at the level given in place of the quality. As
+		// with AVIF, the 'effort' option is only passed if set.
+		if (img->effort >= 0) {
+			result = vips_webpsave_buffer(img->internal, buf, len,
+				"Q", img->near_lossless > 0 ? img->near_lossless : (img->quality > 0 ? img->quality : 75),
+				"effort", img->effort,
+				"lossless", img->lossless || img->near_lossless > 0,
+				"near_lossless", img->near_lossless > 0,
+				"strip", img->strip, NULL);
+		} else {
+			result = vips_webpsave_buffer(img->internal, buf, len,
+				"Q", img->near_lossless > 0 ? img->near_lossless : (img->quality > 0 ? img->quality : 75),
+				"lossless", img->lossless || img->near_lossless > 0,
+				"near_lossless", img->near_lossless > 0,
+				"strip", img->strip, NULL);
+		}
+
+		break;
+	default:
 		// Saving to GIF not supported yet.
-		errno = 1;
-		return;
+		result = -1;
+		break;
 	}
 
+	// Stop watching evaluation progress, as the internal representation may be shared with copies of
+	// the image, which outlive this image.
+	g_signal_handler_disconnect(img->internal, handler);
+
 	// Check for possible error during processing.
 	if (result != 0) {
 		errno = 1;
@@ -79,6 +382,16 @@ void ico_image_destroy(ico_image *img) {
 	free(img);
 }
 
+void ico_image_replace(ico_image *img, VipsImage *internal) {
+	g_object_unref(img->internal);
+	img->internal = internal;
+
+	// The original image buffer may no longer correspond to the image, and cannot be used for
+	// shrink-on-load operations.
+	img->data.buffer = NULL;
+	img->data.len = 0;
+}
+
 int ico_image_width(ico_image *img) {
 	return vips_image_get_width(img->internal);
 }
@@ -86,3 +399,7 @@ int ico_image_width(ico_image *img) {
 int ico_image_height(ico_image *img) {
 	return vips_image_get_height(img->internal);
 }
+
+int ico_image_pages(ico_image *img) {
+	return vips_image_get_n_pages(img->internal);
+}
@@ -1,3 +1,7 @@
+// Package pipeline implements image processing for the Ico service, and may also
+// be used as a standalone library, independent of any HTTP service. Images are
+// processed against a pipeline of operations, as described by a parameter list,
+// e.g. 'width=500,fit=crop'.
 package pipeline
 
 // #cgo pkg-config: vips
@@ -11,8 +15,12 @@ import "C"
 
 import (
 	// Standard library.
+	"context"
 	"fmt"
+	"math"
 	"runtime"
+	"strings"
+	"sync"
 	"unsafe"
 
 	// Internal packages.
@@ -23,64 +31,743 @@ import (
 // resizing cropping. The results of processing an operation against a specific
 // image are guaranteed to be deterministic.
 type Operation interface {
-	Process(*C.ico_image) error
+	Process(*Handle) error
+}
+
+// An OperationFunc initializes an operation from the parameters provided. A nil
+// operation is returned if the operation is not applicable for the parameters.
+type OperationFunc func(*Params) (Operation, error)
+
+// A Handle refers to the internal representation of an image being processed,
+// and is passed to each operation in turn. Operations implemented outside this
+// package may access the underlying VIPS image via the VipsImage method, and
+// replace it with the processed result via the SetVipsImage method.
+type Handle C.ico_image
+
+// Width returns the current width of the image, in pixels.
+func (h *Handle) Width() int64 {
+	return int64(C.ico_image_width((*C.ico_image)(h)))
+}
+
+// Height returns the current height of the image, in pixels.
+func (h *Handle) Height() int64 {
+	return int64(C.ico_image_height((*C.ico_image)(h)))
+}
+
+// VipsImage returns a pointer to the underlying 'VipsImage' for the image.
+func (h *Handle) VipsImage() unsafe.Pointer {
+	return unsafe.Pointer(h.internal)
+}
+
+// SetVipsImage replaces the underlying 'VipsImage' for the image with the one
+// provided, releasing the reference held to the existing 'VipsImage'. The
+// reference held for the 'VipsImage' provided passes to the Handle.
+func (h *Handle) SetVipsImage(ptr unsafe.Pointer) {
+	C.ico_image_replace((*C.ico_image)(h), (*C.VipsImage)(ptr))
+}
+
+// A Loader is an Operation which requires additional images for processing, e.g.
+// for compositing, which are fetched using the FetchFunc provided before any
+// operations are processed.
+type Loader interface {
+	Load(FetchFunc) error
+}
+
+// A FetchFunc fetches the image stored under the name provided.
+type FetchFunc func(name string) (*image.Image, error)
+
+// An operation initializer, registered under a unique name.
+type operation struct {
+	name string
+	init OperationFunc
 }
 
 // An ordered list of all possible operations in a pipeline.
-var operations = []func(*Params) (Operation, error){
-	NewResize,
+var operations = []operation{
+	{"page", NewPage},
+	{"extract", NewExtract},
+	{"trim", NewTrim},
+	{"resize", NewResize},
+	{"tint", NewTint},
+	{"composite", NewComposite},
+	{"text", NewText},
+	{"output", NewOutput},
+}
+
+// RegisterOperation adds an operation to the list of operations available in
+// pipelines, under a unique name. The operation is placed before the operation
+// named in 'before', or at the end of the list if 'before' is empty. Operations
+// should be registered during package initialization, as registration is not
+// safe for concurrent use with pipelines being initialized.
+func RegisterOperation(name string, init OperationFunc, before string) error {
+	pos := len(operations)
+	for i, op := range operations {
+		if op.name == name {
+			return fmt.Errorf("Operation '%s' already exists, refusing to overwrite", name)
+		} else if op.name == before {
+			pos = i
+		}
+	}
+
+	if before != "" && pos == len(operations) {
+		return fmt.Errorf("Operation '%s' not found, unable to register '%s' before it", before, name)
+	}
+
+	operations = append(operations[:pos], append([]operation{{name, init}}, operations[pos:]...)...)
+	return nil
+}
+
+// A LimitError is returned when processing an image would exceed any of the
+// limits set for the pipeline.
+type LimitError struct {
+	msg string
+}
+
+// Error returns the message for the limit exceeded.
+func (e *LimitError) Error() string {
+	return e.msg
+}
+
+// A DecodeError is returned when image data of a known type cannot be loaded,
+// e.g. for truncated or otherwise corrupt images.
+type DecodeError struct {
+	msg string
+}
+
+// Error returns the message for the image that failed to load, including the
+// error reported by the VIPS library.
+func (e *DecodeError) Error() string {
+	return e.msg
+}
+
+// An UnsupportedError is returned when the linked VIPS library has no loader for
+// image data, e.g. for HEIF images where the VIPS library was built without HEIF
+// support, as opposed to image data that is corrupt.
+type UnsupportedError struct {
+	msg string
+}
+
+// Error returns the message for the image that has no loader.
+func (e *UnsupportedError) Error() string {
+	return e.msg
+}
+
+// Returns a DecodeError for the image provided, using the last error reported by
+// the VIPS library, or an UnsupportedError if the linked VIPS library has no
+// loader for the image data.
+func decodeError(img *image.Image) error {
+	msg := vipsError()
+	if len(img.Data) > 0 && C.ico_loader_exists(unsafe.Pointer(&img.Data[0]), C.size_t(len(img.Data))) == 0 {
+		vipsError() // Discard error reported for missing loader.
+		return &UnsupportedError{fmt.Sprintf("no loader available for image of type '%s': %s", img.Type.String(), msg)}
+	}
+
+	return &DecodeError{fmt.Sprintf("failed to load image of type '%s': %s", img.Type.String(), msg)}
 }
 
 // A Pipeline represents all data required for converting an image from its
 // original format to the processed result.
 type Pipeline struct {
+	Fetch     FetchFunc // The function used for fetching any additional images required.
+	MaxFrames int64     // The maximum number of frames allowed in images. Zero means no limit.
+	Hash      bool      // Whether a perceptual hash is computed for processed images.
+	Color     string    // The method colors are computed with for processed images, if any.
+	Formats   []string  // The output formats allowed for processed images. Empty means all formats.
+	Debug     bool      // Whether the steps applied while processing are recorded in Steps.
+	Steps     []Step    // The steps applied while processing, if Debug is set.
+
+	// The maximum width and height requested for processed images, in pixels. Requested dimensions
+	// exceeding the maximum are scaled down to it, unless MaxDimensionError is set, in which case
+	// processing fails instead. Zero means no limit.
+	MaxDimension      int64
+	MaxDimensionError bool
+
+	// The combinations of width and height allowed for processed images, with zero standing for an
+	// unset dimension. Requested dimensions not allowed are snapped to the nearest combination allowed
+	// if DimensionSnap is set, and have processing fail otherwise. Empty means any dimensions.
+	Dimensions    [][2]int64
+	DimensionSnap bool
+
 	operations []Operation
+	names      []string // The names operations are registered under, in the same order as operations.
+}
+
+// A Step describes an operation applied while processing an image, along with the
+// dimensions of the image after applying the operation. The first step recorded is
+// named 'load', and describes the image before any operation is applied.
+type Step struct {
+	Name   string `json:"name"`
+	Width  int64  `json:"width"`
+	Height int64  `json:"height"`
 }
 
 // Process applies the set of operations defined for the pipeline against the
 // provided image data. An error is returned if processing fails at any point,
 // otherwise the image provided is modified in-place and nil is returned.
 func (p *Pipeline) Process(img *image.Image) error {
+	return p.ProcessContext(context.Background(), img)
+}
+
+// ProcessContext applies the set of operations defined for the pipeline against
+// the provided image data, as with Process. Processing is stopped if the context
+// provided is cancelled or expires before processing completes, in which case
+// the context error is returned. Operations computing results eagerly, such as
+// decoding images or finding the bounds for trimming, cannot be interrupted, and
+// processing is only stopped once these have completed.
+func (p *Pipeline) ProcessContext(ctx context.Context, img *image.Image) error {
+	// Vector images are passed through unchanged, unless an output format has been
+	// requested, in which case they are rendered at the requested size.
+	if img.Type == image.SVG && p.output().Format == "" {
+		return nil
+	}
+
+	if err := checkLoad(img); err != nil {
+		return err
+	}
+
+	if err := p.load(); err != nil {
+		return err
+	}
+
 	// Initialize internal image representation.
 	ptr, err := C.ico_image_new(unsafe.Pointer(&img.Data[0]), C.size_t(img.Size), C.int(img.Type))
+	if err != nil {
+		return decodeError(img)
+	}
+
+	defer C.ico_image_destroy(ptr)
+
+	// Load page selected for multi-page images, if any, in place of the first page.
+	if page := p.page(); page > 0 {
+		if n := int64(C.ico_image_pages(ptr)); page >= n {
+			return &LimitError{fmt.Sprintf("page %d does not exist, image has %d pages", page, n)}
+		}
+
+		if _, err := C.ico_image_load_page(ptr, C.int(page)); err != nil {
+			return decodeError(img)
+		}
+	}
+
+	// Images optimized losslessly keep their original format, including formats not
+	// otherwise written, such as HEIF, which is checked against the formats allowed.
+	if p.output().Optimize == "lossless" {
+		ptr.output = C.int(img.Type)
+	}
+
+	// Check image against limits before any early return below, as these apply to
+	// images returned with metadata stripped, or optimized losslessly, as well.
+	if err := p.check(ptr); err != nil {
+		return err
+	}
+
+	// Strip metadata from image data directly if no other change is requested, which
+	// avoids any loss of quality from re-encoding the image. Images that cannot be
+	// stripped directly are processed as usual.
+	if p.metadataOnly(ptr, img) {
+		if data, err := stripJPEG(img.Data, false); err == nil {
+			img.Data, img.Size = data, int64(len(data))
+			return nil
+		}
+	}
+
+	// Re-encode image losslessly, keeping the original format, if requested.
+	if p.output().Optimize == "lossless" {
+		return p.optimizeLossless(ctx, ptr, img)
+	}
+
+	return p.process(ctx, ptr, img)
+}
+
+// ProcessDecoded applies the set of operations defined for the pipeline against
+// the decoded image provided, as with ProcessContext, and stores the result in
+// the image provided. The decoded image is left unchanged, and may be processed
+// against other pipelines. Decoded images only contain their first page, and
+// pipelines selecting any other page cannot be processed against them.
+func (p *Pipeline) ProcessDecoded(ctx context.Context, dec *Decoded, img *image.Image) error {
+	// Vector images are passed through unchanged, as with ProcessContext.
+	if img.Type == image.SVG && p.output().Format == "" {
+		return nil
+	}
+
+	if p.page() > 0 {
+		return fmt.Errorf("unable to select page for decoded image")
+	}
+
+	if err := p.load(); err != nil {
+		return err
+	}
+
+	// Initialize internal image representation, sharing decoded image data.
+	ptr, err := C.ico_image_copy(dec.ptr)
 	if err != nil {
 		return fmt.Errorf("failed to initialize image for pipeline: %s", p.Error())
 	}
 
-	// Apply ordered list of operations in turn.
+	defer C.ico_image_destroy(ptr)
+
+	if err := p.check(ptr); err != nil {
+		return err
+	}
+
+	return p.process(ctx, ptr, img)
+}
+
+// Checks the number of frames, the dimensions requested, and the output format
+// for the internal image representation provided against the limits set for the
+// pipeline, ahead of any processing. Formats selected automatically are only
+// known once operations are applied, and are checked separately.
+func (p *Pipeline) check(ptr *C.ico_image) error {
+	// Check number of frames for animated or multi-page images against limit.
+	if n := int64(C.ico_image_pages(ptr)); p.MaxFrames > 0 && n > p.MaxFrames {
+		return &LimitError{fmt.Sprintf("image has %d frames, more than the maximum of %d", n, p.MaxFrames)}
+	}
+
+	// Check dimensions requested for image against limit.
+	if err := p.limitDimension(); err != nil {
+		return err
+	}
+
+	// Check dimensions requested for image against the dimensions allowed, if any.
+	if err := p.allowDimension(); err != nil {
+		return err
+	}
+
+	// Check output format for image against the formats allowed, if any.
+	if p.output().Format != "auto" {
+		if err := p.checkFormat(ptr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fetches any additional images required by operations in the pipeline.
+func (p *Pipeline) load() error {
 	for _, op := range p.operations {
-		if err = op.Process(ptr); err != nil {
+		if l, ok := op.(Loader); ok {
+			if p.Fetch == nil {
+				return fmt.Errorf("unable to fetch images for pipeline, no fetch function set")
+			}
+
+			if err := l.Load(p.Fetch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Applies the ordered list of operations against the internal image representation
+// provided, and writes the result to the image given.
+func (p *Pipeline) process(ctx context.Context, ptr *C.ico_image, img *image.Image) error {
+	// Stop processing image if context is done before processing completes. The
+	// image is destroyed only after we have stopped watching the context.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			C.ico_image_kill(ptr)
+		case <-done:
+		}
+	}()
+
+	defer wg.Wait()
+	defer close(done)
+
+	p.Steps = nil
+	if p.Debug {
+		p.record("load", ptr)
+	}
+
+	// Apply operations to each frame of animated images in turn, if the output
+	// format supports animation. Decoded images only ever contain a single frame.
+	if p.animated() && img.Type == image.GIF && ptr.data.buffer != nil && C.ico_image_pages(ptr) > 1 {
+		if err := p.applyFrames(ctx, ptr); err != nil {
+			return err
+		}
+	} else if err := p.apply(ctx, ptr, p.Debug); err != nil {
+		return err
+	}
+
+	if p.output().Format == "auto" {
+		if err := p.checkFormat(ptr); err != nil {
+			return err
+		}
+	}
+
+	// Compute perceptual hash from the processed image before writing, if requested.
+	var hash string
+	if p.Hash {
+		h, err := perceptualHash(ptr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		hash = formatHash(h)
+	}
+
+	// Compute color from the processed image before writing, if requested.
+	var color string
+	if p.Color != "" {
+		c, err := imageColor(ptr, p.Color)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
 			return err
 		}
+
+		color = c
 	}
 
 	// Write internal image representation to buffer.
 	var buf unsafe.Pointer
 	var len C.size_t
 
-	if _, err = C.ico_image_write(ptr, &buf, &len); err != nil {
+	if _, err := C.ico_image_write(ptr, &buf, &len); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		return fmt.Errorf("failed to write to image: %s", p.Error())
 	}
 
 	// Copy internal buffer to byte slice.
 	img.Data = C.GoBytes(buf, C.int(len))
 	img.Size = int64(len)
+	img.Type = image.Kind(ptr.output)
+	img.Hash = hash
+	img.Color = color
 
 	// Clean up references to internal buffers.
-	C.ico_image_destroy(ptr)
 	C.g_free(buf)
 
 	return nil
 }
 
+// Applies the ordered list of operations against the internal image representation
+// provided, in turn, recording each step applied if requested.
+func (p *Pipeline) apply(ctx context.Context, ptr *C.ico_image, record bool) error {
+	for i, op := range p.operations {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Operations failing after processing has been stopped return the context
+		// error, rather than the error reported for the operation.
+		if err := op.Process((*Handle)(ptr)); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		if record {
+			p.record(p.names[i], ptr)
+		}
+	}
+
+	return nil
+}
+
+// Records a step for the operation named, along with the current dimensions of the
+// image provided.
+func (p *Pipeline) record(name string, ptr *C.ico_image) {
+	h := (*Handle)(ptr)
+	p.Steps = append(p.Steps, Step{Name: name, Width: h.Width(), Height: h.Height()})
+}
+
+// Loads all frames for the animated image provided, and applies the ordered list
+// of operations against each frame in turn, joining the processed frames back
+// into the image provided. Operations are required to produce frames of the same
+// size for all frames, and steps are only recorded for the first frame.
+func (p *Pipeline) applyFrames(ctx context.Context, ptr *C.ico_image) error {
+	if _, err := C.ico_image_load_pages(ptr); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("failed to load frames for image: %s", p.Error())
+	}
+
+	n := int(C.ico_image_pages(ptr))
+
+	// Frame list is allocated in C memory, as it is passed to C for joining.
+	list := C.calloc(C.size_t(n), C.size_t(unsafe.Sizeof(ptr)))
+	if list == nil {
+		return fmt.Errorf("failed to allocate memory for frames")
+	}
+
+	frames := unsafe.Slice((**C.ico_image)(list), n)
+	defer func() {
+		for _, f := range frames {
+			if f != nil {
+				C.ico_image_destroy(f)
+			}
+		}
+
+		C.free(list)
+	}()
+
+	for i := range frames {
+		f, err := C.ico_image_frame(ptr, C.int(i))
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return fmt.Errorf("failed to extract frame %d from image: %s", i, p.Error())
+		}
+
+		frames[i] = f
+		if err = p.apply(ctx, f, p.Debug && i == 0); err != nil {
+			return err
+		}
+	}
+
+	if _, err := C.ico_image_join(ptr, &frames[0], C.int(n)); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("failed to join frames for image: %s", p.Error())
+	}
+
+	return nil
+}
+
+// Checks the dimensions requested for resize operations in the pipeline against the
+// maximum dimension set, scaling them down to the maximum, or returning an error if
+// requested.
+func (p *Pipeline) limitDimension() error {
+	if p.MaxDimension <= 0 {
+		return nil
+	}
+
+	for _, op := range p.operations {
+		r, ok := op.(*Resize)
+		if !ok || r.dimension() <= p.MaxDimension {
+			continue
+		}
+
+		if p.MaxDimensionError {
+			return &LimitError{fmt.Sprintf("requested dimension of %d pixels is more than the maximum of %d", r.dimension(), p.MaxDimension)}
+		}
+
+		r.clamp(p.MaxDimension)
+	}
+
+	return nil
+}
+
+// Checks the dimensions requested against the combinations of width and height
+// allowed, if any, after any limits on dimensions are applied, and either snaps
+// dimensions to the nearest combination allowed or returns a LimitError. Images
+// requested without any dimensions are always allowed, and images requested by
+// their longest or shortest side never are, as these cannot be matched.
+func (p *Pipeline) allowDimension() error {
+	if len(p.Dimensions) == 0 {
+		return nil
+	}
+
+	for _, op := range p.operations {
+		r, ok := op.(*Resize)
+		if !ok || r.dimension() == 0 {
+			continue
+		} else if r.Longest > 0 || r.Shortest > 0 {
+			return &LimitError{"dimensions may only be requested as width and height"}
+		}
+
+		// Find nearest combination allowed, by total difference in width and height.
+		nearest, diff := [2]int64{}, -1.0
+		for _, d := range p.Dimensions {
+			n := math.Abs(float64(d[0]-r.Width)) + math.Abs(float64(d[1]-r.Height))
+			if diff < 0 || n < diff {
+				nearest, diff = d, n
+			}
+		}
+
+		if diff == 0 {
+			continue
+		} else if !p.DimensionSnap {
+			return &LimitError{fmt.Sprintf("requested dimensions of %dx%d pixels are not allowed", r.Width, r.Height)}
+		}
+
+		r.Width, r.Height = nearest[0], nearest[1]
+	}
+
+	return nil
+}
+
+// Returns true if the pipeline output format supports animation.
+func (p *Pipeline) animated() bool {
+	return p.output().animated()
+}
+
+// Returns the page selected for processing, or zero if the pipeline selects no page.
+func (p *Pipeline) page() int64 {
+	for _, op := range p.operations {
+		if pg, ok := op.(*Page); ok {
+			return pg.Page
+		}
+	}
+
+	return 0
+}
+
+// Returns a LimitError if the output format for the image provided, either as
+// requested, selected automatically, or as determined by the original image
+// format, is not among the formats allowed for the pipeline. All formats are
+// allowed if none are set.
+func (p *Pipeline) checkFormat(ptr *C.ico_image) error {
+	if len(p.Formats) == 0 {
+		return nil
+	}
+
+	name := p.output().Format
+	if name == "" || name == "auto" {
+		output := image.Kind(ptr.output)
+		name = output.Name()
+	}
+
+	for _, f := range p.Formats {
+		if f == name {
+			return nil
+		}
+	}
+
+	return &LimitError{fmt.Sprintf("output format '%s' is not allowed, use one of: %s", name, strings.Join(p.Formats, ", "))}
+}
+
+// Returns the output operation for the pipeline, which is applied for all
+// pipelines initialized via New.
+func (p *Pipeline) output() *Output {
+	for _, op := range p.operations {
+		if o, ok := op.(*Output); ok {
+			return o
+		}
+	}
+
+	return &Output{}
+}
+
+// A Decoded image contains image data decoded into memory, which may be processed
+// against multiple pipelines without having to decode the image data each time,
+// e.g. when resizing an image to multiple sizes. Decoded images hold resources
+// outside the Go runtime, and must be released with Close when no longer used.
+type Decoded struct {
+	ptr *C.ico_image
+}
+
+// Decode decodes the image data provided into memory, for use in ProcessDecoded.
+// Operations that depend on the original image data, such as shrinking images on
+// load, are not available for decoded images.
+func Decode(img *image.Image) (*Decoded, error) {
+	if err := Init(); err != nil {
+		return nil, err
+	}
+
+	if err := checkLoad(img); err != nil {
+		return nil, err
+	}
+
+	ptr, err := C.ico_image_new(unsafe.Pointer(&img.Data[0]), C.size_t(img.Size), C.int(img.Type))
+	if err != nil {
+		return nil, decodeError(img)
+	}
+
+	if _, err = C.ico_image_decode(ptr); err != nil {
+		C.ico_image_destroy(ptr)
+		return nil, decodeError(img)
+	}
+
+	return &Decoded{ptr}, nil
+}
+
+// Close releases all resources held for the decoded image.
+func (d *Decoded) Close() {
+	if d.ptr != nil {
+		C.ico_image_destroy(d.ptr)
+		d.ptr = nil
+	}
+}
+
 // Error returns the last error generated by the pipeline, if any.
 func (p *Pipeline) Error() error {
-	return fmt.Errorf("%s", C.GoString(C.ico_error()))
+	return fmt.Errorf("%s", vipsError())
+}
+
+// DropCache drops all operations cached by the VIPS library, releasing memory
+// held for cached results.
+func DropCache() {
+	if err := Init(); err != nil {
+		return
+	}
+
+	C.vips_cache_drop_all()
+}
+
+// Returns the errors reported by the VIPS library since the last call, clearing
+// the error buffer, which would otherwise accumulate errors across pipelines.
+// Errors are copied and cleared in a single call, and are to be taken right after
+// the failing call, so that errors reported by concurrent pipelines in between
+// are not returned to the wrong pipeline, or cleared before being returned.
+func vipsError() string {
+	msg := C.ico_error()
+	defer C.g_free(C.gpointer(msg))
+
+	return strings.TrimSpace(C.GoString(msg))
+}
+
+// Transform processes the image data provided against the pipeline described by
+// the parameter list, and returns the processed image data along with its MIME
+// type. Operations requiring additional images are not supported, and pipelines
+// containing them will return an error; use New and set the Fetch function for
+// the Pipeline returned instead.
+func Transform(data []byte, params string) ([]byte, string, error) {
+	img, err := image.New(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	p, err := New(params)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err = p.Process(img); err != nil {
+		return nil, "", err
+	}
+
+	return img.Data, img.Type.String(), nil
 }
 
 // New parses the parameter list provided and initializes a Pipeline and
 // supporting list of Operations stored within.
 func New(params string) (*Pipeline, error) {
+	return NewWithDefaults(params, "")
+}
+
+// NewWithDefaults parses the parameter list provided and initializes a Pipeline
+// as with New, using values in the default parameter list for any parameters not
+// set in the parameter list itself.
+func NewWithDefaults(params, defaults string) (*Pipeline, error) {
+	if err := Init(); err != nil {
+		return nil, err
+	}
+
 	// Initialize and prepare pipeline.
 	p := &Pipeline{operations: make([]Operation, 0)}
 
@@ -90,11 +777,25 @@ func New(params string) (*Pipeline, error) {
 		return nil, fmt.Errorf("unable to parse parameters: %s", err)
 	}
 
+	// Merge default parameters into parameter list, if any.
+	if defaults != "" {
+		def, err := Parse(defaults)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse default parameters: %s", err)
+		}
+
+		for k, v := range *def {
+			if _, exists := (*prm)[k]; !exists {
+				(*prm)[k] = v
+			}
+		}
+	}
+
 	// Iterate through ordered list of operations, checking for eligibility with
 	// regards to the request parameters used. Operations that are to be executed
 	// are initialized and appended to the pipeline's list of operations.
-	for _, init := range operations {
-		op, err := init(prm)
+	for _, o := range operations {
+		op, err := o.init(prm)
 		if err != nil {
 			return nil, err
 		} else if op == nil {
@@ -104,17 +805,41 @@ func New(params string) (*Pipeline, error) {
 		}
 
 		p.operations = append(p.operations, op)
+		p.names = append(p.names, o.name)
 	}
 
 	return p, nil
 }
 
-// Initialize package variables and set up VIPS library for future processing.
-func init() {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+// Version returns the version of the linked VIPS library, e.g. '8.14.2'. The
+// library does not need to be initialized beforehand.
+func Version() string {
+	return C.GoString(C.vips_version_string())
+}
 
-	if ok := C.ico_init(); ok != 0 {
-		panic("failed to initialize VIPS library")
-	}
+// Used for initializing the VIPS library once, along with any error returned.
+var (
+	initOnce sync.Once
+	initErr  error
+)
+
+// Init sets up the VIPS library for processing, and probes the list of formats
+// supported. The library is initialized on first use, and calling Init is only
+// required for handling initialization errors ahead of time. Init is safe for
+// concurrent use, and initializes the library exactly once, returning the same
+// error for all calls if initialization failed.
+func Init() error {
+	initOnce.Do(func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		if ok := C.ico_init(); ok != 0 {
+			initErr = fmt.Errorf("failed to initialize VIPS library: %s", vipsError())
+			return
+		}
+
+		probeFormats()
+	})
+
+	return initErr
 }
@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	// Standard library.
+	"context"
+	"testing"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// Processes the fixture given against a new pipeline for the parameters given,
+// for each iteration of the benchmark, as is done for each request to the Ico
+// service. Profiles for benchmarks may be written via the '-cpuprofile' and
+// '-memprofile' flags for 'go test', though memory allocated by VIPS is not
+// included in memory profiles.
+func benchmarkPipeline(b *testing.B, name, params string) {
+	orig := fixture(b, name)
+
+	b.ReportAllocs()
+	b.SetBytes(orig.Size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p, err := New(params)
+		if err != nil {
+			b.Fatalf("failed to initialize pipeline for '%s': %s", params, err)
+		}
+
+		img := &image.Image{Data: orig.Data, Size: orig.Size, Type: orig.Type}
+		if err = p.Process(img); err != nil {
+			b.Fatalf("failed to process '%s' against '%s': %s", name, params, err)
+		}
+	}
+}
+
+func BenchmarkResize(b *testing.B) {
+	benchmarkPipeline(b, "photo.jpg", "width=160")
+}
+
+func BenchmarkResizeShrink(b *testing.B) {
+	benchmarkPipeline(b, "photo.jpg", "width=40")
+}
+
+func BenchmarkCrop(b *testing.B) {
+	benchmarkPipeline(b, "photo.jpg", "width=100,height=100,fit=crop")
+}
+
+func BenchmarkCropFocus(b *testing.B) {
+	benchmarkPipeline(b, "photo.jpg", "width=100,height=100,fit=crop:focus")
+}
+
+func BenchmarkConvertPNG(b *testing.B) {
+	benchmarkPipeline(b, "photo.jpg", "format=png")
+}
+
+func BenchmarkConvertWebP(b *testing.B) {
+	requireSave(b, "webp")
+	benchmarkPipeline(b, "photo.jpg", "format=webp")
+}
+
+func BenchmarkConvertAVIF(b *testing.B) {
+	requireSave(b, "avif")
+	benchmarkPipeline(b, "photo.jpg", "format=avif")
+}
+
+func BenchmarkConvertAlpha(b *testing.B) {
+	requireSave(b, "webp")
+	benchmarkPipeline(b, "alpha.png", "width=32,format=webp")
+}
+
+// Processes the fixture given against pipelines for each of the widths given,
+// decoding the fixture once for all widths, as is done for responsive image sets.
+func BenchmarkDecoded(b *testing.B) {
+	orig := fixture(b, "photo.jpg")
+	params := []string{"width=80", "width=160", "width=240"}
+
+	b.ReportAllocs()
+	b.SetBytes(orig.Size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dec, err := Decode(orig)
+		if err != nil {
+			b.Fatalf("failed to decode fixture: %s", err)
+		}
+
+		for _, prm := range params {
+			p, err := New(prm)
+			if err != nil {
+				b.Fatalf("failed to initialize pipeline for '%s': %s", prm, err)
+			}
+
+			img := &image.Image{Data: orig.Data, Size: orig.Size, Type: orig.Type}
+			if err = p.ProcessDecoded(context.Background(), dec, img); err != nil {
+				dec.Close()
+				b.Fatalf("failed to process decoded fixture against '%s': %s", prm, err)
+			}
+		}
+
+		dec.Close()
+	}
+}
@@ -0,0 +1,155 @@
+package pipeline
+
+import (
+	// Standard library.
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// Returns the image stored under the name given in the 'testdata' directory,
+// failing the test if the image cannot be read. A new image is returned for each
+// call, as pipelines replace image data in-place.
+func fixture(tb testing.TB, name string) *image.Image {
+	tb.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		tb.Fatalf("failed to read fixture '%s': %s", name, err)
+	}
+
+	img, err := image.New(data)
+	if err != nil {
+		tb.Fatalf("failed to initialize fixture '%s': %s", name, err)
+	}
+
+	return img
+}
+
+// Skips the test if saving images in the format given is not supported by the
+// linked VIPS library, which may have been built without support for it.
+func requireSave(tb testing.TB, name string) {
+	tb.Helper()
+
+	if !Formats()[name].Save {
+		tb.Skipf("saving images of type '%s' is not supported by the linked VIPS library", name)
+	}
+}
+
+// A stamp is an operation registered by tests via RegisterOperation, which records
+// the dimensions of images when processed, standing in for operations implemented
+// outside this package.
+type stamp struct {
+	Name string `key:"stamp" valid:"^[a-z]+$"`
+
+	width, height int64
+}
+
+// Process records the dimensions of the image provided, leaving it unchanged.
+func (s *stamp) Process(handle *Handle) error {
+	s.width, s.height = handle.Width(), handle.Height()
+	return nil
+}
+
+// Initializes a stamp operation from the parameters provided, or returns nil if no
+// 'stamp' parameter is given.
+func newStamp(p *Params) (Operation, error) {
+	s := &stamp{}
+	if err := p.Unpack(s); err != nil {
+		return nil, err
+	} else if s.Name == "" {
+		return nil, nil
+	}
+
+	return s, nil
+}
+
+func init() {
+	if err := RegisterOperation("stamp", newStamp, "output"); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisterOperation(t *testing.T) {
+	if err := RegisterOperation("stamp", newStamp, ""); err == nil {
+		t.Error("RegisterOperation(\"stamp\") succeeded for existing operation, expected error")
+	}
+
+	if err := RegisterOperation("unknown", newStamp, "missing"); err == nil {
+		t.Error("RegisterOperation(\"unknown\") succeeded before missing operation, expected error")
+	}
+
+	// Operations are only added to pipelines with parameters matching them.
+	p, err := New("width=160")
+	if err != nil {
+		t.Fatalf("New(\"width=160\") returned error: %s", err)
+	}
+
+	for _, op := range p.operations {
+		if _, ok := op.(*stamp); ok {
+			t.Errorf("New(\"width=160\") added operation 'stamp' without parameter")
+		}
+	}
+
+	if _, err := New("stamp=Invalid"); err == nil {
+		t.Error("New(\"stamp=Invalid\") succeeded, expected validation error")
+	}
+
+	// Registered operations are placed before the operation named, and are applied
+	// after all operations placed before them.
+	p, err = New("width=160,stamp=test")
+	if err != nil {
+		t.Fatalf("New(\"width=160,stamp=test\") returned error: %s", err)
+	}
+
+	if len(p.operations) != 3 {
+		t.Fatalf("New(\"width=160,stamp=test\") has %d operations, want 3", len(p.operations))
+	}
+
+	_, resize := p.operations[0].(*Resize)
+	s, stamped := p.operations[1].(*stamp)
+	_, output := p.operations[2].(*Output)
+	if !resize || !stamped || !output {
+		t.Fatalf("New(\"width=160,stamp=test\") has operations %T, %T and %T, want resize, stamp and output", p.operations[0], p.operations[1], p.operations[2])
+	}
+
+	if s.Name != "test" {
+		t.Errorf("operation 'stamp' unpacked name '%s', want 'test'", s.Name)
+	}
+
+	if err := p.Process(fixture(t, "photo.jpg")); err != nil {
+		t.Fatalf("Process() returned error: %s", err)
+	}
+
+	if s.width != 160 || s.height != 120 {
+		t.Errorf("operation 'stamp' processed image of %dx%d, want 160x120", s.width, s.height)
+	}
+}
+
+func TestProcessTruncated(t *testing.T) {
+	// The fixture is cut short before its first scan, and cannot be loaded at all.
+	const prefix = "failed to load image of type 'image/jpeg': "
+
+	p, err := New("width=160")
+	if err != nil {
+		t.Fatalf("New(\"width=160\") returned error: %s", err)
+	}
+
+	err = p.Process(fixture(t, "truncated.jpg"))
+	if _, ok := err.(*DecodeError); !ok {
+		t.Fatalf("Process() returned error '%v', want DecodeError", err)
+	} else if msg := err.Error(); !strings.HasPrefix(msg, prefix) || len(msg) == len(prefix) {
+		t.Errorf("Process() returned error '%s', want error detail from VIPS", msg)
+	}
+
+	_, err = Decode(fixture(t, "truncated.jpg"))
+	if _, ok := err.(*DecodeError); !ok {
+		t.Fatalf("Decode() returned error '%v', want DecodeError", err)
+	} else if msg := err.Error(); !strings.HasPrefix(msg, prefix) || len(msg) == len(prefix) {
+		t.Errorf("Decode() returned error '%s', want error detail from VIPS", msg)
+	}
+}
@@ -0,0 +1,55 @@
+#include <errno.h>
+#include <stdlib.h>
+#include <vips/vips.h>
+
+#include "pipeline.h"
+#include "placeholder.h"
+
+void ico_placeholder(const void *data, size_t len, int size, double sigma, void **buf, size_t *out) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+	VipsImage *in;
+	double white[3] = {255, 255, 255};
+	VipsArrayDouble *background;
+
+	// Thumbnails are loaded with shrink-on-load where supported by the image format, which avoids
+	// decoding the image at full size.
+	if (vips_thumbnail_buffer((void *) data, len, &t[0], size, "height", size, NULL) != 0) {
+		g_object_unref(base);
+		errno = 1;
+		return;
+	}
+
+	in = t[0];
+
+	// Transparent areas are flattened against a white background, as placeholders are written as JPEG.
+	if (vips_image_hasalpha(in)) {
+		background = vips_array_double_new(white, vips_image_get_bands(in) - 1);
+		if (vips_flatten(in, &t[1], "background", background, NULL) != 0) {
+			vips_area_unref(VIPS_AREA(background));
+			g_object_unref(base);
+			errno = 1;
+			return;
+		}
+
+		vips_area_unref(VIPS_AREA(background));
+		in = t[1];
+	}
+
+	if (vips_gaussblur(in, &t[2], sigma, NULL) != 0) {
+		g_object_unref(base);
+		errno = 1;
+		return;
+	}
+
+	if (vips_jpegsave_buffer(t[2], buf, out, "Q", 50, "strip", TRUE, NULL) != 0) {
+		g_object_unref(base);
+		errno = 1;
+		return;
+	}
+
+	g_object_unref(base);
+
+	errno = 0;
+	return;
+}
@@ -0,0 +1,52 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "placeholder.h"
+import "C"
+
+import (
+	// Standard library.
+	"unsafe"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// The size of the longest side of placeholder images, in pixels, and the amount
+// of blur applied to placeholder images, as the sigma of a Gaussian blur.
+const (
+	placeholderSize  = 32
+	placeholderSigma = 2
+)
+
+// Placeholder returns a small, blurred rendition of the image provided, for use
+// in place of the image while it is being processed. Placeholders are written as
+// JPEG images, with their longest side scaled to 32 pixels, and keep the aspect
+// ratio of the image provided. Only the first frame of animated images is used.
+func Placeholder(img *image.Image) (*image.Image, error) {
+	if err := Init(); err != nil {
+		return nil, err
+	}
+
+	if err := checkLoad(img); err != nil {
+		return nil, err
+	}
+
+	var buf unsafe.Pointer
+	var len C.size_t
+
+	_, err := C.ico_placeholder(unsafe.Pointer(&img.Data[0]), C.size_t(img.Size), C.int(placeholderSize), C.double(placeholderSigma), &buf, &len)
+	if err != nil {
+		return nil, decodeError(img)
+	}
+
+	defer C.g_free(buf)
+
+	return &image.Image{Data: C.GoBytes(buf, C.int(len)), Size: int64(len), Type: image.JPEG}, nil
+}
@@ -6,6 +6,23 @@
 #include "pipeline.h"
 #include "resize.h"
 
+void ico_image_render(ico_image *img, double scale) {
+	VipsImage *tmp = NULL;
+
+	// Vector images are rendered from the original buffer at the scale requested, which avoids any
+	// loss of quality from scaling the image after rendering.
+	if (vips_svgload_buffer((void *) img->data.buffer, img->data.len, &tmp, "scale", scale, NULL) != 0) {
+		errno = 1;
+		return;
+	}
+
+	g_object_unref(img->internal);
+	img->internal = tmp;
+
+	errno = 0;
+	return;
+}
+
 void ico_image_shrink(ico_image *img, double factor) {
 	// Return without shrinking if factor is less than 2.
 	if (factor < 2) {
@@ -14,8 +31,9 @@ void ico_image_shrink(ico_image *img, double factor) {
 	}
 
 	// JPEG images support a shrink-on-load operation, which is much more efficient
-	// than generating a full-size image and shrinking afterwards.
-	if (img->type == TYPE_JPEG) {
+	// than generating a full-size image and shrinking afterwards. This is only
+	// possible if the original buffer still corresponds to the image.
+	if (img->type == TYPE_JPEG && img->data.buffer != NULL) {
 		int shrink = 2;
 		VipsImage *tmp = NULL;
 
@@ -60,13 +78,31 @@ void ico_image_shrink(ico_image *img, double factor) {
 	return;
 }
 
-void ico_image_affine(ico_image *img, double factor) {
+void ico_image_affine(ico_image *img, double xscale, double yscale, int kernel) {
 	VipsImage *tmp = NULL;
-	double residual = floor(factor) / factor;
+	VipsInterpolate *interpolate;
+	int result;
+
+	// Resize image by the horizontal and vertical scale given, using the interpolation kernel
+	// requested. Lanczos resampling is not available as an interpolator for affine transforms, and is
+	// applied via a reduce operation instead, which takes the inverse of the scale.
+	switch (kernel) {
+	case KERNEL_LANCZOS3:
+		result = vips_reduce(img->internal, &tmp, 1 / xscale, 1 / yscale, "kernel", VIPS_KERNEL_LANCZOS3, NULL);
+		break;
+	case KERNEL_NEAREST:
+	case KERNEL_BICUBIC:
+		interpolate = vips_interpolate_new(kernel == KERNEL_NEAREST ? "nearest" : "bicubic");
+		result = vips_affine(img->internal, &tmp, xscale, 0, 0, yscale, "interpolate", interpolate, NULL);
+		g_object_unref(interpolate);
+		break;
+	default:
+		// Uses a bilinear interpolator for blending by default.
+		result = vips_affine(img->internal, &tmp, xscale, 0, 0, yscale, NULL);
+		break;
+	}
 
-	// Resize image by the residual factor. By default, uses a bilinear interpolator
-	// for blending.
-	if (vips_affine(img->internal, &tmp, residual, 0, 0, residual, NULL) != 0) {
+	if (result != 0) {
 		errno = 1;
 		return;
 	}
@@ -94,3 +130,54 @@ void ico_image_crop(ico_image *img, int x, int y, int w, int h) {
 	errno = 0;
 	return;
 }
+
+const void *ico_image_xmp(ico_image *img, size_t *len) {
+	const void *data = NULL;
+
+	// Return empty result for images without XMP metadata.
+	if (vips_image_get_typeof(img->internal, VIPS_META_XMP_NAME) == 0) {
+		*len = 0;
+		return NULL;
+	}
+
+	if (vips_image_get_blob(img->internal, VIPS_META_XMP_NAME, &data, len) != 0) {
+		*len = 0;
+		return NULL;
+	}
+
+	return data;
+}
+
+void ico_image_embed(ico_image *img, int x, int y, int w, int h, double r, double g, double b) {
+	VipsImage *tmp = NULL;
+	VipsArrayDouble *background;
+	int bands = vips_image_get_bands(img->internal);
+	double color[4] = {r, g, b, 255};
+
+	// Images with fewer than three bands are greyscale, and take the luminance of the background
+	// color as their first band, and full opacity as their alpha band, if any.
+	if (bands < 3) {
+		color[0] = 0.2126 * r + 0.7152 * g + 0.0722 * b;
+		color[1] = 255;
+	}
+
+	if (bands > 4) {
+		bands = 4;
+	}
+
+	// Place image within a canvas of the requested size, filling the remaining area with the
+	// background color.
+	background = vips_array_double_new(color, bands);
+	if (vips_embed(img->internal, &tmp, x, y, w, h, "extend", VIPS_EXTEND_BACKGROUND, "background", background, NULL) != 0) {
+		vips_area_unref(VIPS_AREA(background));
+		errno = 1;
+		return;
+	}
+
+	vips_area_unref(VIPS_AREA(background));
+	g_object_unref(img->internal);
+	img->internal = tmp;
+
+	errno = 0;
+	return;
+}
@@ -13,35 +13,118 @@ import "C"
 
 import (
 	// Standard library.
+	"bytes"
 	"fmt"
 	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // Resize is an operation for manipulating image dimensions, including clipping,
 // cropping and focusing within images.
 type Resize struct {
-	Width  int64 `key:"width"`
-	Height int64 `key:"height"`
-	Fit    struct {
-		Kind string `key:"fit" default:"clip" valid:"crop"`
+	Width      int64  `key:"width"`
+	Height     int64  `key:"height"`
+	Longest    int64  `key:"longest"`
+	Shortest   int64  `key:"shortest"`
+	Background string `key:"background" default:"ffffff" valid:"^[0-9a-fA-F]{6}$"`
+	Kernel     string `key:"kernel" default:"bilinear" valid:"^(nearest|bilinear|bicubic|lanczos3)$"`
+	Even       string `key:"even" default:"false" valid:"^(true|false)$"`
+	Fit        struct {
+		Kind string `key:"fit" default:"clip" valid:"crop|pad"`
 		Crop struct {
-			Gravity string `key:"fit=crop" default:"center" valid:"top|bottom|left|right|point"`
+			Gravity string `key:"fit=crop" default:"center" valid:"top|bottom|left|right|point|focus"`
 			Point   struct {
-				X int64 `key:"fit=crop:point" index:"0"`
-				Y int64 `key:"fit=crop:point" index:"1"`
+				X float64 `key:"fit=crop:point" index:"0"`
+				Y float64 `key:"fit=crop:point" index:"1"`
+			}
+			Focus struct {
+				Gravity string `key:"fit=crop:focus" default:"center" valid:"^(top|bottom|left|right|center)$"`
 			}
 		}
 	}
+	Aspect struct {
+		Width  float64 `key:"aspect" index:"0" valid:"^[0-9]+([.][0-9]+)?$"`
+		Height float64 `key:"aspect" index:"1" valid:"^[0-9]+([.][0-9]+)?$"`
+	}
+
+	faces [][4]float64 // Bounding boxes for faces in the original image, as X, Y, width and height.
+}
+
+// A lookup table of interpolation kernel names against their internal values.
+// Operations with no kernel set use bilinear interpolation.
+var kernelLookup = map[string]C.int{
+	"nearest":  C.KERNEL_NEAREST,
+	"bilinear": C.KERNEL_BILINEAR,
+	"bicubic":  C.KERNEL_BICUBIC,
+	"lanczos3": C.KERNEL_LANCZOS3,
 }
 
 // Process applies the pre-defined constraints for this operation onto the image
 // provided, changing the data in-place and freeing any additional allocations
 // made automatically. Returns an error if processing fails for any reason.
-func (r *Resize) Process(img *C.ico_image) error {
-	// Do not process image if pipeline requests an identical or enlarged image.
+func (r *Resize) Process(handle *Handle) error {
+	img := (*C.ico_image)(handle)
+
+	// Crop point is recalculated while processing, and is kept on a copy of the
+	// operation, as the operation may be applied to multiple frames in turn.
+	op := *r
+	r = &op
+
+	// Resolve aspect ratio requested into the dimensions of the target area, if needed.
+	r.resolveAspect(int64(C.ico_image_width(img)), int64(C.ico_image_height(img)))
+
+	// Render vector images at the scale required for the requested size, which may be larger than
+	// the size the image is rendered at by default.
+	scale := 1.0
+	if img._type == C.TYPE_SVG && img.data.buffer != nil {
+		if factor := r.resizeFactor(img); factor > 0 {
+			if _, err := C.ico_image_render(img, C.double(1/factor)); err != nil {
+				return fmt.Errorf("failed to render image: %s", vipsError())
+			}
+
+			scale = 1 / factor
+		}
+	}
+
+	// Do not resize image if pipeline requests an identical or enlarged image. Only resizing is skipped,
+	// and all other operations, such as format conversion, are still applied. Padded images are always
+	// processed, as their dimensions are required to match the requested dimensions exactly.
 	w, h := int64(C.ico_image_width(img)), int64(C.ico_image_height(img))
-	if (r.Width > w || r.Height > h) || (r.Width == w && r.Height == h) {
-		return nil
+	if r.Fit.Kind != "pad" && ((r.Width > w || r.Height > h) || (r.Width == w && r.Height == h)) {
+		return r.roundEven(img)
+	}
+
+	// Convert crop point coordinates given as fractions of the image size to pixel coordinates.
+	if x := r.Fit.Crop.Point.X; x > 0 && x < 1 {
+		r.Fit.Crop.Point.X = x * float64(w)
+	}
+
+	if y := r.Fit.Crop.Point.Y; y > 0 && y < 1 {
+		r.Fit.Crop.Point.Y = y * float64(h)
+	}
+
+	// Use center of the faces given as crop point, if any fit within the crop area, falling back to
+	// the gravity given otherwise.
+	if r.Fit.Kind == "crop" && len(r.faces) > 0 {
+		if x, y, ok, err := r.facePoint(img, scale); err != nil {
+			return err
+		} else if ok {
+			r.Fit.Crop.Gravity = "point"
+			r.Fit.Crop.Point.X, r.Fit.Crop.Point.Y = x, y
+		}
+	}
+
+	// Use focal point embedded in image metadata as crop point, if requested, falling back to the
+	// gravity given if the image has no focal point.
+	if r.Fit.Kind == "crop" && r.Fit.Crop.Gravity == "focus" {
+		r.Fit.Crop.Gravity = r.Fit.Crop.Focus.Gravity
+		if x, y, ok := focusPoint(img); ok {
+			r.Fit.Crop.Gravity = "point"
+			r.Fit.Crop.Point.X, r.Fit.Crop.Point.Y = x*float64(w), y*float64(h)
+		}
 	}
 
 	// Get base resize factor for resulting image.
@@ -50,7 +133,7 @@ func (r *Resize) Process(img *C.ico_image) error {
 	// Shrink image by integer factor, if needed.
 	if factor >= 2 {
 		if _, err := C.ico_image_shrink(img, C.double(factor)); err != nil {
-			return fmt.Errorf("failed to shrink image")
+			return fmt.Errorf("failed to shrink image: %s", vipsError())
 		}
 
 		// Recalculate crop point for shrunk image.
@@ -60,14 +143,17 @@ func (r *Resize) Process(img *C.ico_image) error {
 		factor = r.resizeFactor(img)
 	}
 
-	// Resize image by remaining factor, if any.
-	if factor > 1 {
-		if _, err := C.ico_image_affine(img, C.double(factor)); err != nil {
-			return fmt.Errorf("failed to affine resize image")
+	// Resize image by remaining factor, if any, rounding dimensions calculated from the aspect ratio
+	// of the image to even numbers beforehand, if requested.
+	if xs, ys := r.scale(img, factor); xs != 1 || ys != 1 {
+		if _, err := C.ico_image_affine(img, C.double(xs), C.double(ys), kernelLookup[r.Kernel]); err != nil {
+			return fmt.Errorf("failed to affine resize image: %s", vipsError())
 		}
 
 		// Recalculate crop point for resized image.
-		r.Fit.Crop.Point.X, r.Fit.Crop.Point.Y = r.cropPoint(factor)
+		if factor > 1 {
+			r.Fit.Crop.Point.X, r.Fit.Crop.Point.Y = r.cropPoint(factor)
+		}
 	}
 
 	// Apply specified fit mode
@@ -83,13 +169,125 @@ func (r *Resize) Process(img *C.ico_image) error {
 
 		_, err := C.ico_image_crop(img, C.int(bx), C.int(by), C.int(bw), C.int(bh))
 		if err != nil {
-			return fmt.Errorf("failed to crop image")
+			return fmt.Errorf("failed to crop image: %s", vipsError())
+		}
+	case "pad":
+		w, h := int64(C.ico_image_width(img)), int64(C.ico_image_height(img))
+
+		// Do not pad image if image is already the requested size.
+		if w == r.Width && h == r.Height {
+			break
+		}
+
+		// Place image in the center of the requested area, filling in with the background color.
+		x, y := (r.Width-w)/2, (r.Height-h)/2
+		cr, cg, cb := parseColor(r.Background)
+
+		_, err := C.ico_image_embed(img, C.int(x), C.int(y), C.int(r.Width), C.int(r.Height), C.double(cr), C.double(cg), C.double(cb))
+		if err != nil {
+			return fmt.Errorf("failed to pad image: %s", vipsError())
+		}
+	}
+
+	return r.roundEven(img)
+}
+
+// Sets the width and height of the target area to the aspect ratio requested, if
+// any, for an image of the dimensions given. Dimensions requested are kept where
+// possible, and shrunk to fit the ratio within the area requested otherwise. If no
+// dimensions are requested, the target area is the largest area of the requested
+// ratio within the image for crops, or the smallest area containing the image for
+// pads. Images are always cropped to the aspect ratio unless padded.
+func (r *Resize) resolveAspect(w, h int64) {
+	if r.Aspect.Width <= 0 || r.Aspect.Height <= 0 {
+		return
+	}
+
+	ratio := r.Aspect.Width / r.Aspect.Height
+	if r.Fit.Kind != "pad" {
+		r.Fit.Kind = "crop"
+	}
+
+	// Constraints on the longest or shortest side apply to the width or height,
+	// depending on the orientation of the aspect ratio.
+	if (r.Longest > 0 && ratio >= 1) || (r.Shortest > 0 && ratio < 1) {
+		r.Width = r.Longest + r.Shortest
+	} else if r.Longest > 0 || r.Shortest > 0 {
+		r.Height = r.Longest + r.Shortest
+	}
+
+	r.Longest, r.Shortest = 0, 0
+	size := func(d float64) int64 {
+		return int64(math.Max(1, math.Floor(d+0.5)))
+	}
+
+	switch {
+	case r.Width > 0 && r.Height > 0:
+		if float64(r.Width)/float64(r.Height) > ratio {
+			r.Width = size(float64(r.Height) * ratio)
+		} else {
+			r.Height = size(float64(r.Width) / ratio)
 		}
+	case r.Width > 0:
+		r.Height = size(float64(r.Width) / ratio)
+	case r.Height > 0:
+		r.Width = size(float64(r.Height) * ratio)
+	case (float64(w)/float64(h) > ratio) == (r.Fit.Kind == "crop"):
+		r.Width, r.Height = size(float64(h)*ratio), h
+	default:
+		r.Width, r.Height = w, size(float64(w)/ratio)
+	}
+}
+
+// Rounds any image dimension not explicitly requested, and thus calculated from
+// the aspect ratio of the image, to the nearest even number, if requested, by
+// scaling the image slightly. This applies to images not otherwise resized, as
+// dimensions are rounded before resizing otherwise.
+func (r *Resize) roundEven(img *C.ico_image) error {
+	xs, ys := r.scale(img, 1)
+	if xs == 1 && ys == 1 {
+		return nil
+	}
+
+	if _, err := C.ico_image_affine(img, C.double(xs), C.double(ys), kernelLookup[r.Kernel]); err != nil {
+		return fmt.Errorf("failed to round image dimensions: %s", vipsError())
 	}
 
 	return nil
 }
 
+// Returns the horizontal and vertical scale for resizing the image provided by the
+// factor given, where factors of 1 or less keep the image at its current size. Any
+// dimension not explicitly requested is rounded to the nearest even number, if
+// requested, with ties rounding down, which changes the scale for the dimension
+// slightly, rather than removing the last row or column of pixels after resizing.
+func (r *Resize) scale(img *C.ico_image, factor float64) (float64, float64) {
+	w, h := float64(C.ico_image_width(img)), float64(C.ico_image_height(img))
+
+	xs, ys := 1.0, 1.0
+	if factor > 1 {
+		xs, ys = 1/factor, 1/factor
+	}
+
+	if r.Even != "true" {
+		return xs, ys
+	}
+
+	even := func(d float64) float64 {
+		return math.Max(2, 2*math.Ceil(d/2-0.5))
+	}
+
+	if r.Width <= 0 && w > 1 {
+		xs = even(w*xs) / w
+	}
+
+	if r.Height <= 0 && h > 1 {
+		ys = even(h*ys) / h
+	}
+
+	return xs, ys
+}
+
 // Returns the resize factor (the difference between image size and requested
 // final size) as a floating point number. For example, requesting a 500x500
 // crop of a 1000x1000 image would return a factor of 2.
@@ -116,53 +314,256 @@ func (r *Resize) resizeFactor(img *C.ico_image) float64 {
 	// Fixed height, auto width.
 	case r.Height > 0:
 		factor = float64(h) / float64(r.Height)
+	// Fixed longest side, depending on image orientation.
+	case r.Longest > 0:
+		factor = math.Max(float64(w), float64(h)) / float64(r.Longest)
+	// Fixed shortest side, depending on image orientation.
+	case r.Shortest > 0:
+		factor = math.Min(float64(w), float64(h)) / float64(r.Shortest)
 	}
 
 	return factor
 }
 
+// Returns the largest of the dimensions requested for the image, in pixels.
+func (r *Resize) dimension() int64 {
+	return int64(math.Max(math.Max(float64(r.Width), float64(r.Height)), math.Max(float64(r.Longest), float64(r.Shortest))))
+}
+
+// Scales the requested dimensions so that none exceeds the maximum given, keeping
+// the ratio between width and height for images with both set.
+func (r *Resize) clamp(max int64) {
+	size := r.dimension()
+	if size <= max {
+		return
+	}
+
+	scale := func(d int64) int64 {
+		if d <= 0 {
+			return d
+		}
+
+		return int64(math.Max(1, math.Floor(float64(d)*float64(max)/float64(size))))
+	}
+
+	r.Width, r.Height = scale(r.Width), scale(r.Height)
+	r.Longest, r.Shortest = scale(r.Longest), scale(r.Shortest)
+}
+
 // Returns the pre-defined center of gravity as a pair of X/Y coordinates.
-func (r *Resize) cropPoint(factor float64) (int64, int64) {
+func (r *Resize) cropPoint(factor float64) (float64, float64) {
 	x, y := r.Fit.Crop.Point.X, r.Fit.Crop.Point.Y
-	return int64(float64(x) / factor), int64(float64(y) / factor)
+	return x / factor, y / factor
 }
 
-// Returns the boundaries for the area to extract from the provided image.
+// Returns the boundaries for the area to extract from the provided image. The
+// area is clamped to the image dimensions for all gravities, and is shrunk to
+// fit within the image if the requested size exceeds the image size.
 func (r *Resize) cropBounds(img *C.ico_image) (int64, int64, int64, int64) {
 	var x, y int64
 	w, h := int64(C.ico_image_width(img)), int64(C.ico_image_height(img))
 
+	// Shrink bounding box to fit within image, using the full image dimension for
+	// any dimension not requested.
+	bw, bh := r.Width, r.Height
+	if bw <= 0 || bw > w {
+		bw = w
+	}
+
+	if bh <= 0 || bh > h {
+		bh = h
+	}
+
 	// Set crop bounds for specified crop gravity.
 	switch r.Fit.Crop.Gravity {
 	case "point":
 		// Set X and Y coordinates for bounding box, based on the pre-defined
-		// center point, and modify the box for image constraints.
-		x = ((r.Fit.Crop.Point.X) - (r.Width / 2))
-		y = ((r.Fit.Crop.Point.Y) - (r.Height / 2))
-
-		x = int64(math.Min(math.Max(0, float64(x)), float64((w - r.Width))))
-		y = int64(math.Min(math.Max(0, float64(y)), float64((h - r.Height))))
+		// center point.
+		x = int64(r.Fit.Crop.Point.X) - (bw / 2)
+		y = int64(r.Fit.Crop.Point.Y) - (bh / 2)
 	case "left":
-		y = (h - r.Height) / 2
+		y = (h - bh) / 2
 	case "right":
-		x = w - r.Width
-		y = (h - r.Height) / 2
+		x = w - bw
+		y = (h - bh) / 2
 	case "top":
-		x = (w - r.Width) / 2
+		x = (w - bw) / 2
 	case "bottom":
-		x = (w - r.Width) / 2
-		y = h - r.Height
+		x = (w - bw) / 2
+		y = h - bh
 	default:
-		x = (w - r.Width) / 2
-		y = (h - r.Height) / 2
+		x = (w - bw) / 2
+		y = (h - bh) / 2
+	}
+
+	// Clamp bounding box within image constraints.
+	x = int64(math.Min(math.Max(0, float64(x)), float64(w-bw)))
+	y = int64(math.Min(math.Max(0, float64(y)), float64(h-bh)))
+
+	return x, y, bw, bh
+}
+
+// Returns the center point of the area containing as many of the faces given for
+// the resize operation as fit within the crop area for the image provided, or
+// false if no face fits. Faces are added to the area in order of size,
+// starting from each face in turn, and the area containing the most faces wins,
+// with ties broken by total face area. Returns a LimitError if any face extends
+// past the dimensions of the original image.
+//
+// Faces are given in pixels of the original image, and are translated to the
+// image provided, which may only contain a region of the original image, e.g.
+// after an extract or trim operation, and which is scaled by the factor given,
+// e.g. for vector images rendered at a different size. Faces lying outside the
+// image provided are ignored, and faces lying partially outside are clipped.
+func (r *Resize) facePoint(img *C.ico_image, scale float64) (float64, float64, bool, error) {
+	w, h := int64(C.ico_image_width(img)), int64(C.ico_image_height(img))
+	ow, oh := int64(img.origin.width), int64(img.origin.height)
+	left, top := float64(img.origin.left), float64(img.origin.top)
+
+	var faces [][4]float64
+	for _, f := range r.faces {
+		if f[0]+f[2] > float64(ow) || f[1]+f[3] > float64(oh) {
+			return 0, 0, false, &LimitError{fmt.Sprintf("faces: box '%g:%g:%g:%g' exceeds image dimensions of %dx%d", f[0], f[1], f[2], f[3], ow, oh)}
+		}
+
+		x1, y1 := math.Max(f[0]-left, 0)*scale, math.Max(f[1]-top, 0)*scale
+		x2, y2 := math.Min((f[0]+f[2]-left)*scale, float64(w)), math.Min((f[1]+f[3]-top)*scale, float64(h))
+		if x2 > x1 && y2 > y1 {
+			faces = append(faces, [4]float64{x1, y1, x2 - x1, y2 - y1})
+		}
+	}
+
+	// Determine size of crop area in image pixels, as cropped after resizing.
+	cw, ch := float64(w), float64(h)
+	if factor := r.resizeFactor(img); factor > 0 {
+		if r.Width > 0 {
+			cw = math.Min(cw, float64(r.Width)*factor)
+		}
+		if r.Height > 0 {
+			ch = math.Min(ch, float64(r.Height)*factor)
+		}
+	}
+
+	sort.SliceStable(faces, func(i, j int) bool { return faces[i][2]*faces[i][3] > faces[j][2]*faces[j][3] })
+
+	var best [4]float64
+	var bestCount int
+	var bestArea float64
+
+	for i := range faces {
+		area := faces[i]
+		count, total := 0, 0.0
+		for j := -1; j < len(faces); j++ {
+			f := faces[i]
+			if j >= 0 {
+				if j == i {
+					continue
+				}
+				f = faces[j]
+			}
+
+			x1, y1 := math.Min(area[0], f[0]), math.Min(area[1], f[1])
+			x2, y2 := math.Max(area[0]+area[2], f[0]+f[2]), math.Max(area[1]+area[3], f[1]+f[3])
+			if x2-x1 > cw || y2-y1 > ch {
+				continue
+			}
+
+			area = [4]float64{x1, y1, x2 - x1, y2 - y1}
+			count, total = count+1, total+f[2]*f[3]
+		}
+
+		if count > bestCount || (count == bestCount && total > bestArea) {
+			best, bestCount, bestArea = area, count, total
+		}
+	}
+
+	if bestCount == 0 {
+		return 0, 0, false, nil
 	}
 
-	return x, y, r.Width, r.Height
+	return best[0] + best[2]/2, best[1] + best[3]/2, true, nil
+}
+
+// Matches focus areas in XMP metadata, as defined by the Metadata Working Group
+// regions schema, and their center point coordinates.
+var (
+	focusRegion = regexp.MustCompile(`mwg-rs:Type="Focus"`)
+	focusX      = regexp.MustCompile(`stArea:x="([0-9.]+)"`)
+	focusY      = regexp.MustCompile(`stArea:y="([0-9.]+)"`)
+)
+
+// Returns the focal point embedded in XMP metadata for the image, as fractions
+// of the image width and height. Only the first region of type 'Focus' is used,
+// and its area is expected to be given in normalized coordinates.
+func focusPoint(img *C.ico_image) (float64, float64, bool) {
+	var size C.size_t
+
+	ptr := C.ico_image_xmp(img, &size)
+	if ptr == nil || size == 0 {
+		return 0, 0, false
+	}
+
+	xmp := C.GoBytes(ptr, C.int(size))
+
+	// Find the first focus region, and restrict search for coordinates to it.
+	loc := focusRegion.FindIndex(xmp)
+	if loc == nil {
+		return 0, 0, false
+	}
+
+	region := xmp[loc[1]:]
+	if end := bytes.Index(region, []byte("</rdf:li>")); end >= 0 {
+		region = region[:end]
+	}
+
+	mx, my := focusX.FindSubmatch(region), focusY.FindSubmatch(region)
+	if mx == nil || my == nil {
+		return 0, 0, false
+	}
+
+	x, errx := strconv.ParseFloat(string(mx[1]), 64)
+	y, erry := strconv.ParseFloat(string(my[1]), 64)
+	if errx != nil || erry != nil || x < 0 || x > 1 || y < 0 || y > 1 {
+		return 0, 0, false
+	}
+
+	return x, y, true
+}
+
+// Returns the face bounding boxes in the value given, as a ':'-separated list of
+// X, Y, width and height for each face in turn, e.g. '10:20:100:120:300:40:80:90'
+// for two faces. Coordinates are given in pixels of the original image.
+func parseFaces(value string) ([][4]float64, error) {
+	parts := strings.Split(value, ":")
+	if len(parts)%4 != 0 {
+		return nil, fmt.Errorf("faces: value '%s' is not a list of 'x:y:width:height' boxes", value)
+	}
+
+	var faces [][4]float64
+	for i := 0; i < len(parts); i += 4 {
+		var f [4]float64
+		for j := range f {
+			v, err := strconv.ParseFloat(parts[i+j], 64)
+			if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+				return nil, fmt.Errorf("faces: value '%s' is not a non-negative number", parts[i+j])
+			}
+
+			f[j] = v
+		}
+
+		if f[2] == 0 || f[3] == 0 {
+			return nil, fmt.Errorf("faces: box '%s' has no area", strings.Join(parts[i:i+4], ":"))
+		}
+
+		faces = append(faces, f)
+	}
+
+	return faces, nil
 }
 
 // NewResize attempts to initialize a resize operation from the parameters
-// provided. Width and/or height parameters have to be provided, otherwise the
-// resize operation is skipped.
+// provided. Width and/or height parameters, or one of the longest or shortest
+// side parameters, have to be provided, otherwise the resize operation is skipped.
 func NewResize(p *Params) (Operation, error) {
 	// Instantiate and unpack pipeline parameters into operation.
 	r := &Resize{}
@@ -170,10 +571,40 @@ func NewResize(p *Params) (Operation, error) {
 		return nil, err
 	}
 
-	// Check for required pipeline parameters.
-	if r.Width == 0 && r.Height == 0 {
+	// Check for required pipeline parameters. An aspect ratio may be given on its
+	// own, in which case images are cropped or padded at their original size.
+	if r.Width == 0 && r.Height == 0 && r.Longest == 0 && r.Shortest == 0 && r.Aspect.Width == 0 && r.Aspect.Height == 0 {
 		return nil, nil
 	}
 
+	if (r.Aspect.Width != 0 || r.Aspect.Height != 0) && (r.Aspect.Width <= 0 || r.Aspect.Height <= 0) {
+		return nil, fmt.Errorf("aspect: ratio must be given as two positive numbers, e.g. '16:9'")
+	}
+
+	// Constraints on the longest or shortest side replace explicit dimensions.
+	if (r.Longest != 0 || r.Shortest != 0) && (r.Width != 0 || r.Height != 0) {
+		return nil, fmt.Errorf("longest, shortest: cannot be combined with width or height")
+	} else if r.Longest != 0 && r.Shortest != 0 {
+		return nil, fmt.Errorf("longest, shortest: cannot be combined with each other")
+	}
+
+	// Faces are given as a list of bounding boxes, each as four values, and are
+	// only used for cropping.
+	if v, ok := (*p)["faces"]; ok {
+		faces, err := parseFaces(v)
+		if err != nil {
+			return nil, err
+		} else if r.Fit.Kind != "crop" {
+			return nil, fmt.Errorf("faces: requires fit mode 'crop'")
+		}
+
+		r.faces = faces
+	}
+
+	// Padding requires exact dimensions to pad towards.
+	if r.Fit.Kind == "pad" && (r.Width <= 0 || r.Height <= 0) && r.Aspect.Width == 0 {
+		return nil, fmt.Errorf("fit: mode 'pad' requires both width and height, or aspect, to be set")
+	}
+
 	return r, nil
 }
@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	// Standard library.
+	"bytes"
+	"image/png"
+	"testing"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// FuzzResizeParams checks that parsing resize parameters never panics, and that
+// resize operations are only initialized for valid combinations of parameters.
+func FuzzResizeParams(f *testing.F) {
+	for _, params := range []string{
+		"width=500",
+		"height=300,even=true",
+		"longest=800",
+		"shortest=200,kernel=lanczos3",
+		"width=100,height=100,fit=crop",
+		"width=100,height=100,fit=crop:point:0.2:0.8",
+		"width=100,height=100,fit=crop:focus:top",
+		"width=100,height=100,fit=crop,faces=10:20:30:40:100:20:10:10",
+		"width=100,height=100,fit=pad,background=ff0000",
+		"aspect=16:9,fit=pad",
+		"aspect=0:9",
+		"width=100,fit=pad",
+		"longest=100,width=100",
+		"faces=1:2:3",
+		"width=abc",
+	} {
+		f.Add(params)
+	}
+
+	f.Fuzz(func(t *testing.T, params string) {
+		prm, err := Parse(params)
+		if err != nil {
+			return
+		}
+
+		op, err := NewResize(prm)
+		if err != nil || op == nil {
+			return
+		}
+
+		r := op.(*Resize)
+		if (r.Aspect.Width != 0 || r.Aspect.Height != 0) && (r.Aspect.Width <= 0 || r.Aspect.Height <= 0) {
+			t.Errorf("NewResize(%q) accepted aspect ratio %g:%g", params, r.Aspect.Width, r.Aspect.Height)
+		}
+
+		if (r.Longest != 0 || r.Shortest != 0) && (r.Width != 0 || r.Height != 0) {
+			t.Errorf("NewResize(%q) accepted longest or shortest side along with width or height", params)
+		} else if r.Longest != 0 && r.Shortest != 0 {
+			t.Errorf("NewResize(%q) accepted both longest and shortest side", params)
+		}
+
+		if r.Fit.Kind == "pad" && (r.Width <= 0 || r.Height <= 0) && r.Aspect.Width == 0 {
+			t.Errorf("NewResize(%q) accepted fit mode 'pad' without width and height, or aspect", params)
+		}
+
+		for _, face := range r.faces {
+			if r.Fit.Kind != "crop" {
+				t.Errorf("NewResize(%q) accepted faces without fit mode 'crop'", params)
+			}
+
+			for _, v := range face {
+				if v < 0 || v != v {
+					t.Errorf("NewResize(%q) accepted face box %v", params, face)
+				}
+			}
+
+			if face[2] == 0 || face[3] == 0 {
+				t.Errorf("NewResize(%q) accepted face box %v with no area", params, face)
+			}
+		}
+	})
+}
+
+func TestResizeSkipped(t *testing.T) {
+	requireSave(t, "webp")
+
+	// Resizing is skipped for pipelines without dimensions, or with dimensions
+	// exceeding the original image, but other operations are still applied.
+	for _, params := range []string{"format=webp", "width=5000,format=webp", "width=320,height=240,format=webp"} {
+		p, err := New(params)
+		if err != nil {
+			t.Fatalf("New(%q) returned error: %s", params, err)
+		}
+
+		img := fixture(t, "photo.jpg")
+		if err := p.Process(img); err != nil {
+			t.Fatalf("Process() for %q returned error: %s", params, err)
+		}
+
+		if img.Type != image.WEBP {
+			t.Errorf("Process() for %q returned image of type '%s', want 'image/webp'", params, img.Type.String())
+		}
+
+		if detected, err := image.New(img.Data); err != nil || detected.Type != image.WEBP {
+			t.Errorf("Process() for %q returned image data not detected as WebP", params)
+		}
+
+		// Load processed image in a pipeline of its own, for checking its dimensions.
+		load, err := New("format=webp")
+		if err != nil {
+			t.Fatalf("New(\"format=webp\") returned error: %s", err)
+		}
+
+		load.Debug = true
+		if err := load.Process(img); err != nil {
+			t.Fatalf("Process() for processed image returned error: %s", err)
+		} else if s := load.Steps[0]; s.Width != 320 || s.Height != 240 {
+			t.Errorf("Process() for %q returned image of %dx%d, want 320x240", params, s.Width, s.Height)
+		}
+	}
+}
+
+func TestResizeFacesExtract(t *testing.T) {
+	requireSave(t, "png")
+
+	// Faces are given in pixels of the original image, and lie outside the region
+	// extracted from the right half of the fixture, unless translated to it.
+	p, err := New("extract=160:0:160:240,width=160,height=60,fit=crop,faces=250:10:40:40,format=png")
+	if err != nil {
+		t.Fatalf("New() returned error: %s", err)
+	}
+
+	img := fixture(t, "photo.jpg")
+	if err := p.Process(img); err != nil {
+		t.Fatalf("Process() returned error: %s", err)
+	}
+
+	out, err := png.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		t.Fatalf("failed to decode processed image: %s", err)
+	}
+
+	if b := out.Bounds(); b.Dx() != 160 || b.Dy() != 60 {
+		t.Fatalf("Process() returned image of %dx%d, want 160x60", b.Dx(), b.Dy())
+	}
+
+	// The green component of the fixture increases from top to bottom, and is near
+	// zero at the top of the image only if the crop is placed over the face given,
+	// rather than at the center of the image.
+	if _, g, _ := pixelAt(out, 80, 0); g > 30 {
+		t.Errorf("Process() returned green component of %d at top edge, want crop placed over face", g)
+	}
+
+	// Faces extending past the original image are rejected.
+	p, err = New("extract=160:0:160:240,width=160,height=60,fit=crop,faces=300:10:40:40,format=png")
+	if err != nil {
+		t.Fatalf("New() returned error: %s", err)
+	}
+
+	if err := p.Process(fixture(t, "photo.jpg")); err == nil {
+		t.Error("Process() succeeded for face past original image, want error")
+	} else if _, ok := err.(*LimitError); !ok {
+		t.Errorf("Process() returned error '%s', want LimitError", err)
+	}
+}
+
+func TestResizeEven(t *testing.T) {
+	// Dimensions calculated from the aspect ratio of the fixture are rounded to the
+	// nearest even number, which may be larger than the exact dimension.
+	tests := []struct {
+		params        string
+		width, height int64
+	}{
+		{"width=170,even=true", 170, 128},
+		{"width=150,even=true", 150, 112},
+		{"height=85,even=true", 114, 85},
+		{"longest=171,even=true", 170, 128},
+		{"width=5000,even=true", 320, 240},
+	}
+
+	for _, tt := range tests {
+		p, err := New(tt.params)
+		if err != nil {
+			t.Fatalf("New(%q) returned error: %s", tt.params, err)
+		}
+
+		p.Debug = true
+		if err := p.Process(fixture(t, "photo.jpg")); err != nil {
+			t.Fatalf("Process() for %q returned error: %s", tt.params, err)
+		}
+
+		if s := p.Steps[len(p.Steps)-1]; s.Width != tt.width || s.Height != tt.height {
+			t.Errorf("Process() for %q returned image of %dx%d, want %dx%d", tt.params, s.Width, s.Height, tt.width, tt.height)
+		}
+	}
+}
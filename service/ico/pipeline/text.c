@@ -0,0 +1,80 @@
+#include <errno.h>
+#include <stdlib.h>
+#include <vips/vips.h>
+
+#include "pipeline.h"
+#include "composite.h"
+#include "text.h"
+
+void ico_image_text(ico_image *img, const char *text, const char *font, const char *fontfile, double r, double g, double b, int gravity) {
+	VipsImage *mask = NULL, *ink = NULL, *tmp = NULL;
+	VipsImage *bands[2];
+	double color[3] = {r, g, b};
+	int x, y, w = vips_image_get_width(img->internal), h = vips_image_get_height(img->internal);
+
+	// Render text into a single-band mask, wrapping at the image width.
+	if (fontfile != NULL && fontfile[0] != '\0') {
+		if (vips_text(&mask, text, "font", font, "fontfile", fontfile, "width", w, "align", VIPS_ALIGN_CENTRE, NULL) != 0) {
+			errno = 1;
+			return;
+		}
+	} else if (vips_text(&mask, text, "font", font, "width", w, "align", VIPS_ALIGN_CENTRE, NULL) != 0) {
+		errno = 1;
+		return;
+	}
+
+	// Create a solid image of the text color, and use the text mask as its alpha channel.
+	ink = vips_image_new_from_image(mask, color, 3);
+	if (ink == NULL) {
+		g_object_unref(mask);
+		errno = 1;
+		return;
+	}
+
+	bands[0] = ink;
+	bands[1] = mask;
+
+	if (vips_bandjoin(bands, &tmp, 2, NULL) != 0) {
+		g_object_unref(ink);
+		g_object_unref(mask);
+		errno = 1;
+		return;
+	}
+
+	g_object_unref(ink);
+	g_object_unref(mask);
+
+	ico_image overlay = {.internal = NULL};
+	if (vips_copy(tmp, &overlay.internal, "interpretation", VIPS_INTERPRETATION_sRGB, NULL) != 0) {
+		g_object_unref(tmp);
+		errno = 1;
+		return;
+	}
+
+	g_object_unref(tmp);
+
+	// Determine position of text on image for the specified gravity.
+	int tw = vips_image_get_width(overlay.internal), th = vips_image_get_height(overlay.internal);
+
+	switch (gravity) {
+	case GRAVITY_TOP:
+		x = (w - tw) / 2, y = 0;
+		break;
+	case GRAVITY_BOTTOM:
+		x = (w - tw) / 2, y = h - th;
+		break;
+	case GRAVITY_LEFT:
+		x = 0, y = (h - th) / 2;
+		break;
+	case GRAVITY_RIGHT:
+		x = w - tw, y = (h - th) / 2;
+		break;
+	default:
+		x = (w - tw) / 2, y = (h - th) / 2;
+	}
+
+	ico_image_composite(img, &overlay, x, y, 1);
+	g_object_unref(overlay.internal);
+
+	return;
+}
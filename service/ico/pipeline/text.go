@@ -0,0 +1,111 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "text.h"
+import "C"
+
+import (
+	// Standard library.
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"unsafe"
+)
+
+// The directory containing font files used for rendering text, as set via
+// SetFontDir.
+var fontDir atomic.Value
+
+// SetFontDir sets the directory containing font files used for rendering text.
+// Font files requested outside this directory are not accessible. The directory
+// may be changed while pipelines are being processed.
+func SetFontDir(dir string) {
+	fontDir.Store(dir)
+}
+
+// A lookup table of text gravity names against their internal values.
+var textGravityLookup = map[string]C.int{
+	"center": C.GRAVITY_CENTER,
+	"top":    C.GRAVITY_TOP,
+	"bottom": C.GRAVITY_BOTTOM,
+	"left":   C.GRAVITY_LEFT,
+	"right":  C.GRAVITY_RIGHT,
+}
+
+// Text is an operation for rendering a caption over an image, using a
+// configurable font, size, color and position.
+type Text struct {
+	Text     string `key:"text"`
+	Font     string `key:"text-font" default:"sans"`
+	FontFile string `key:"text-fontfile" valid:"^[A-Za-z0-9_-]+\\.(ttf|otf)$"`
+	Size     int64  `key:"text-size" default:"24"`
+	Color    string `key:"text-color" default:"ffffff" valid:"^[0-9a-fA-F]{6}$"`
+	Gravity  string `key:"text-gravity" default:"center" valid:"top|bottom|left|right|center"`
+}
+
+// Process renders the text over the image provided, changing the data in-place.
+// Returns an error if processing fails for any reason.
+func (t *Text) Process(handle *Handle) error {
+	img := (*C.ico_image)(handle)
+
+	var fontfile string
+	if t.FontFile != "" {
+		dir, _ := fontDir.Load().(string)
+		if dir == "" {
+			return fmt.Errorf("unable to use font file '%s', no font directory configured", t.FontFile)
+		}
+
+		fontfile = filepath.Join(dir, t.FontFile)
+	}
+
+	text, font, file := C.CString(t.Text), C.CString(fmt.Sprintf("%s %d", t.Font, t.Size)), C.CString(fontfile)
+	defer C.free(unsafe.Pointer(text))
+	defer C.free(unsafe.Pointer(font))
+	defer C.free(unsafe.Pointer(file))
+
+	r, g, b := parseColor(t.Color)
+	_, err := C.ico_image_text(img, text, font, file, C.double(r), C.double(g), C.double(b), textGravityLookup[t.Gravity])
+	if err != nil {
+		return fmt.Errorf("failed to render text on image: %s", vipsError())
+	}
+
+	return nil
+}
+
+// NewText attempts to initialize a text operation from the parameters provided.
+// The text is expected to be URL-encoded, and the operation is skipped if no
+// text is given.
+func NewText(p *Params) (Operation, error) {
+	// Instantiate and unpack pipeline parameters into operation.
+	t := &Text{}
+	if err := p.Unpack(t); err != nil {
+		return nil, err
+	}
+
+	// Check for required pipeline parameters.
+	if t.Text == "" {
+		return nil, nil
+	}
+
+	var err error
+	if t.Text, err = url.QueryUnescape(t.Text); err != nil {
+		return nil, fmt.Errorf("text: unable to decode text: %s", err)
+	}
+
+	if t.Font, err = url.QueryUnescape(t.Font); err != nil {
+		return nil, fmt.Errorf("text-font: unable to decode font name: %s", err)
+	}
+
+	if t.Size <= 0 {
+		return nil, fmt.Errorf("text-size: value '%d' is not a positive number", t.Size)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,77 @@
+#include <errno.h>
+#include <stdlib.h>
+#include <vips/vips.h>
+
+#include "pipeline.h"
+#include "tint.h"
+
+void ico_image_tint(ico_image *img, const unsigned char *lut) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 7);
+	VipsImage *in = img->internal, *out;
+	int bands = vips_image_get_bands(in), alpha = vips_image_hasalpha(in);
+
+	// Separate any alpha channel from the image, as only color bands are mapped.
+	if (alpha) {
+		if (vips_extract_band(in, &t[0], 0, "n", bands - 1, NULL) != 0 ||
+		    vips_extract_band(in, &t[1], bands - 1, NULL) != 0) {
+			g_object_unref(base);
+			errno = 1;
+			return;
+		}
+
+		in = t[0];
+	}
+
+	// Convert image to 8-bit greyscale, which is used as the index into the lookup table.
+	if (vips_colourspace(in, &t[2], VIPS_INTERPRETATION_B_W, NULL) != 0 ||
+	    vips_cast_uchar(t[2], &t[3], NULL) != 0) {
+		g_object_unref(base);
+		errno = 1;
+		return;
+	}
+
+	// Map each luminance value to its color in the lookup table, given as a 256x1 RGB image.
+	t[4] = vips_image_new_from_memory_copy(lut, 256 * 3, 256, 1, 3, VIPS_FORMAT_UCHAR);
+	if (t[4] == NULL ||
+	    vips_maplut(t[3], &t[5], t[4], NULL) != 0 ||
+	    vips_copy(t[5], &t[6], "interpretation", VIPS_INTERPRETATION_sRGB, NULL) != 0) {
+		g_object_unref(base);
+		errno = 1;
+		return;
+	}
+
+	out = t[6];
+
+	// Join the alpha channel back into the mapped image, scaling 16-bit alpha channels to 8 bits.
+	if (alpha) {
+		VipsImage *a = t[1], *tmp = NULL;
+
+		if (vips_image_get_format(a) == VIPS_FORMAT_USHORT) {
+			if (vips_cast_uchar(a, &tmp, "shift", TRUE, NULL) != 0) {
+				g_object_unref(base);
+				errno = 1;
+				return;
+			}
+
+			vips_object_local(base, tmp);
+			a = tmp;
+		}
+
+		if (vips_bandjoin2(out, a, &tmp, NULL) != 0) {
+			g_object_unref(base);
+			errno = 1;
+			return;
+		}
+
+		vips_object_local(base, tmp);
+		out = tmp;
+	}
+
+	g_object_ref(out);
+	ico_image_replace(img, out);
+	g_object_unref(base);
+
+	errno = 0;
+	return;
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "tint.h"
+import "C"
+
+import (
+	// Standard library.
+	"fmt"
+	"unsafe"
+)
+
+// Tint is an operation for mapping the luminance of images to a range of colors,
+// either through a single tint color, or through a duotone of shadow and
+// highlight colors.
+type Tint struct {
+	Color   string `key:"tint" valid:"^[0-9a-fA-F]{6}$"`
+	Duotone struct {
+		Shadow    string `key:"duotone" index:"0" valid:"^[0-9a-fA-F]{6}$"`
+		Highlight string `key:"duotone" index:"1" valid:"^[0-9a-fA-F]{6}$"`
+	}
+
+	lut []byte // The color for each luminance value, as consecutive RGB triplets.
+}
+
+// Process converts the image provided to greyscale and maps each luminance value
+// to its color, changing the data in-place. Any transparency is kept. Returns an
+// error if processing fails for any reason.
+func (t *Tint) Process(handle *Handle) error {
+	img := (*C.ico_image)(handle)
+
+	if _, err := C.ico_image_tint(img, (*C.uchar)(unsafe.Pointer(&t.lut[0]))); err != nil {
+		return fmt.Errorf("failed to tint image: %s", vipsError())
+	}
+
+	return nil
+}
+
+// Returns a lookup table mapping each of the 256 luminance values to a color, as
+// consecutive RGB triplets, interpolated linearly between the colors given, which
+// are spaced evenly from black to white.
+func tintTable(colors ...string) []byte {
+	lut := make([]byte, 256*3)
+	for i := 0; i < 256; i++ {
+		pos := float64(i) * float64(len(colors)-1) / 255
+		n := int(pos)
+		if n == len(colors)-1 {
+			n--
+		}
+
+		r1, g1, b1 := parseColor(colors[n])
+		r2, g2, b2 := parseColor(colors[n+1])
+		f := pos - float64(n)
+
+		lut[i*3] = byte(float64(r1) + f*float64(r2-r1) + 0.5)
+		lut[i*3+1] = byte(float64(g1) + f*float64(g2-g1) + 0.5)
+		lut[i*3+2] = byte(float64(b1) + f*float64(b2-b1) + 0.5)
+	}
+
+	return lut
+}
+
+// NewTint attempts to initialize a tint operation from the parameters provided.
+// A tint color maps shadows to black and highlights to white, with mid-tones
+// taking the color given, while a duotone maps shadows and highlights to the
+// colors given. The operation is skipped if neither parameter is given.
+func NewTint(p *Params) (Operation, error) {
+	// Instantiate and unpack pipeline parameters into operation.
+	t := &Tint{}
+	if err := p.Unpack(t); err != nil {
+		return nil, err
+	}
+
+	// Check for required pipeline parameters.
+	switch {
+	case t.Color != "" && t.Duotone.Shadow != "":
+		return nil, fmt.Errorf("tint: not supported along with 'duotone'")
+	case t.Color != "":
+		t.lut = tintTable("000000", t.Color, "ffffff")
+	case t.Duotone.Shadow != "":
+		t.lut = tintTable(t.Duotone.Shadow, t.Duotone.Highlight)
+	default:
+		return nil, nil
+	}
+
+	return t, nil
+}
@@ -0,0 +1,201 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "color.h"
+import "C"
+
+import (
+	// Standard library.
+	"bytes"
+	"fmt"
+	"math"
+	"unsafe"
+
+	// Internal packages.
+	"github.com/deuill/mash/service/ico/image"
+)
+
+// The number of shapes drawn for traced placeholders, and the size of the image
+// the shapes are traced from.
+const (
+	traceShapes = 10
+	traceSize   = 64
+)
+
+// The horizontal and vertical radii shapes are chosen from, in pixels of the
+// traced image.
+var traceRadii = [][2]int{{16, 16}, {16, 8}, {8, 16}, {8, 8}, {8, 4}, {4, 8}, {4, 4}}
+
+// A traceShape is an ellipse drawn over traced placeholders at half opacity.
+type traceShape struct {
+	x, y, rx, ry int
+	color        [3]float64
+}
+
+// TracedPlaceholder returns an SVG approximation of the image provided, made up
+// of a background color and a handful of blurred ellipses, for use in place of
+// the image while it is being processed. Traced placeholders are typically less
+// than 1KB in size, scale to any size, and keep the aspect ratio of the image
+// provided. Only the first frame of animated images is used, and transparent
+// areas are filled in with white.
+func TracedPlaceholder(img *image.Image) (*image.Image, error) {
+	if err := Init(); err != nil {
+		return nil, err
+	}
+
+	if err := checkLoad(img); err != nil {
+		return nil, err
+	}
+
+	ptr, err := C.ico_image_new(unsafe.Pointer(&img.Data[0]), C.size_t(img.Size), C.int(img.Type))
+	if err != nil {
+		return nil, decodeError(img)
+	}
+
+	defer C.ico_image_destroy(ptr)
+
+	width, height := int(C.ico_image_width(ptr)), int(C.ico_image_height(ptr))
+
+	pixels := make([]byte, traceSize*traceSize*4)
+	if _, err := C.ico_image_color_pixels(ptr, C.int(traceSize), (*C.uchar)(unsafe.Pointer(&pixels[0]))); err != nil {
+		return nil, fmt.Errorf("failed to trace image: %s", vipsError())
+	}
+
+	// Flatten traced image against a white background, and start from a canvas
+	// filled with the average color.
+	target := make([][3]float64, traceSize*traceSize)
+	var background [3]float64
+	for i := range target {
+		a := float64(pixels[i*4+3]) / 255
+		for c := 0; c < 3; c++ {
+			target[i][c] = float64(pixels[i*4+c])*a + 255*(1-a)
+			background[c] += target[i][c] / float64(len(target))
+		}
+	}
+
+	canvas := make([][3]float64, len(target))
+	for i := range canvas {
+		canvas[i] = background
+	}
+
+	var shapes []traceShape
+	for n := 0; n < traceShapes; n++ {
+		s, ok := traceBestShape(target, canvas)
+		if !ok {
+			break
+		}
+
+		traceDraw(canvas, s, nil)
+		shapes = append(shapes, s)
+	}
+
+	data := traceSVG(width, height, background, shapes)
+	return &image.Image{Data: data, Size: int64(len(data)), Type: image.SVG}, nil
+}
+
+// Returns the shape reducing the difference between the canvas and the target
+// image the most, when drawn over the canvas, or false if no shape reduces the
+// difference. Shapes are chosen among ellipses of each radius in traceRadii,
+// centered on a grid spaced by the smallest radius, and take the mean color of
+// the target image under their area, adjusted for drawing at half opacity.
+func traceBestShape(target, canvas [][3]float64) (traceShape, bool) {
+	var best traceShape
+	var bestGain float64
+
+	for _, r := range traceRadii {
+		step := r[0]
+		if r[1] < step {
+			step = r[1]
+		}
+
+		for y := 0; y < traceSize; y += step {
+			for x := 0; x < traceSize; x += step {
+				s := traceShape{x: x, y: y, rx: r[0], ry: r[1]}
+
+				// The color drawn at half opacity that brings the canvas closest to
+				// the target, on average, for pixels under the shape.
+				var count float64
+				traceDraw(canvas, s, func(i int) {
+					for c := 0; c < 3; c++ {
+						s.color[c] += 2*target[i][c] - canvas[i][c]
+					}
+					count++
+				})
+
+				if count == 0 {
+					continue
+				}
+
+				for c := 0; c < 3; c++ {
+					s.color[c] = math.Max(0, math.Min(255, s.color[c]/count))
+				}
+
+				var gain float64
+				traceDraw(canvas, s, func(i int) {
+					for c := 0; c < 3; c++ {
+						before := target[i][c] - canvas[i][c]
+						after := target[i][c] - (canvas[i][c]+s.color[c])/2
+						gain += before*before - after*after
+					}
+				})
+
+				if gain > bestGain {
+					best, bestGain = s, gain
+				}
+			}
+		}
+	}
+
+	return best, bestGain > 0
+}
+
+// Calls the function given for the index of each pixel of the canvas under the
+// shape given, or draws the shape over the canvas at half opacity if the function
+// given is nil.
+func traceDraw(canvas [][3]float64, s traceShape, fn func(i int)) {
+	for y := s.y - s.ry; y <= s.y+s.ry; y++ {
+		for x := s.x - s.rx; x <= s.x+s.rx; x++ {
+			if x < 0 || y < 0 || x >= traceSize || y >= traceSize {
+				continue
+			}
+
+			dx, dy := float64(x-s.x)/float64(s.rx), float64(y-s.y)/float64(s.ry)
+			if dx*dx+dy*dy > 1 {
+				continue
+			}
+
+			i := y*traceSize + x
+			if fn != nil {
+				fn(i)
+				continue
+			}
+
+			for c := 0; c < 3; c++ {
+				canvas[i][c] = (canvas[i][c] + s.color[c]) / 2
+			}
+		}
+	}
+}
+
+// Returns the SVG document for the background color and shapes given. Shapes are
+// drawn in the coordinates of the traced image, which is stretched to the aspect
+// ratio of the original image, and blurred to smooth out hard edges.
+func traceSVG(width, height int, background [3]float64, shapes []traceShape) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" preserveAspectRatio="none">`, width, height, traceSize, traceSize)
+	fmt.Fprintf(&buf, `<filter id="b"><feGaussianBlur stdDeviation="3"/></filter>`)
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="#%s"/>`, formatColor(background[0], background[1], background[2]))
+	fmt.Fprintf(&buf, `<g filter="url(#b)" fill-opacity=".5">`)
+	for _, s := range shapes {
+		fmt.Fprintf(&buf, `<ellipse cx="%d" cy="%d" rx="%d" ry="%d" fill="#%s"/>`, s.x, s.y, s.rx, s.ry, formatColor(s.color[0], s.color[1], s.color[2]))
+	}
+	fmt.Fprintf(&buf, `</g></svg>`)
+
+	return buf.Bytes()
+}
@@ -0,0 +1,52 @@
+#include <errno.h>
+#include <stdlib.h>
+#include <vips/vips.h>
+
+#include "pipeline.h"
+#include "resize.h"
+#include "trim.h"
+
+void ico_image_trim(ico_image *img, double threshold) {
+	VipsArrayDouble *background;
+	double *color = NULL;
+	int n, left, top, width, height;
+
+	// Use the color of the top-left pixel as the color for the surrounding border.
+	if (vips_getpoint(img->internal, &color, &n, 0, 0, NULL) != 0) {
+		errno = 1;
+		return;
+	}
+
+	background = vips_array_double_new(color, n);
+	g_free(color);
+
+	// Find bounding box for image content, ignoring any near-uniform border.
+	if (vips_find_trim(img->internal, &left, &top, &width, &height, "threshold", threshold, "background", background, NULL) != 0) {
+		vips_area_unref(VIPS_AREA(background));
+		errno = 1;
+		return;
+	}
+
+	vips_area_unref(VIPS_AREA(background));
+
+	// Return without trimming if there is no border, or if the image is entirely uniform.
+	if (width == 0 || height == 0 || (width == vips_image_get_width(img->internal) && height == vips_image_get_height(img->internal))) {
+		errno = 0;
+		return;
+	}
+
+	ico_image_crop(img, left, top, width, height);
+	if (errno != 0) {
+		return;
+	}
+
+	img->origin.left += left;
+	img->origin.top += top;
+
+	// The original image buffer no longer corresponds to the image, and cannot be used for
+	// shrink-on-load operations.
+	img->data.buffer = NULL;
+	img->data.len = 0;
+
+	return;
+}
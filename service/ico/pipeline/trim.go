@@ -0,0 +1,61 @@
+package pipeline
+
+// #cgo pkg-config: vips
+// #cgo CFLAGS: -Iinclude
+//
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// #include "pipeline.h"
+// #include "trim.h"
+import "C"
+
+import (
+	// Standard library.
+	"fmt"
+	"strconv"
+)
+
+// Trim is an operation for removing near-uniform borders surrounding images,
+// as determined by the color of the top-left pixel of the image.
+type Trim struct {
+	Trim string `key:"trim" valid:"^(true|[0-9]+(\\.[0-9]+)?)$"`
+
+	threshold float64 // The maximum difference from the border color for border pixels.
+}
+
+// Process removes any border surrounding the image provided, changing the data
+// in-place. Images with no border are left unchanged. Returns an error if
+// processing fails for any reason.
+func (t *Trim) Process(handle *Handle) error {
+	img := (*C.ico_image)(handle)
+
+	if _, err := C.ico_image_trim(img, C.double(t.threshold)); err != nil {
+		return fmt.Errorf("failed to trim image: %s", vipsError())
+	}
+
+	return nil
+}
+
+// NewTrim attempts to initialize a trim operation from the parameters provided.
+// The trim parameter is either 'true', in which case a default threshold is
+// used, or the threshold itself. The operation is skipped if no parameter is
+// given.
+func NewTrim(p *Params) (Operation, error) {
+	// Instantiate and unpack pipeline parameters into operation.
+	t := &Trim{threshold: 10}
+	if err := p.Unpack(t); err != nil {
+		return nil, err
+	}
+
+	// Check for required pipeline parameters.
+	if t.Trim == "" {
+		return nil, nil
+	}
+
+	if t.Trim != "true" {
+		t.threshold, _ = strconv.ParseFloat(t.Trim, 64)
+	}
+
+	return t, nil
+}
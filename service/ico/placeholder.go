@@ -0,0 +1,71 @@
+package ico
+
+import (
+	// Standard library
+	"context"
+	"net/http"
+
+	// Internal packages
+	"github.com/deuill/mash/service"
+	"github.com/deuill/mash/service/ico/image"
+	"github.com/deuill/mash/service/ico/pipeline"
+)
+
+// A pendingImage identifies an image being processed in the background, by source and path.
+type pendingImage struct {
+	src  *Source
+	path string
+}
+
+// Writes a placeholder for the image pointed to by the request back to the user, and processes the
+// image in the background, unless already processed, so that subsequent requests for the processed
+// image are served from cache. Placeholders are computed from the original image, and do not depend
+// on the pipeline parameters given. Placeholders are traced as SVG images if requested, and are
+// otherwise blurred JPEG images. Placeholders are returned as data URIs, if requested.
+func (m *Ico) placeholder(w http.ResponseWriter, r *http.Request, src *Source, params, imgPath, procPath string, traced bool) (*service.Response, error) {
+	orig, err := src.Get(imgPath)
+	if err != nil {
+		return nil, sourceError(err, "failed to fetch from source")
+	}
+
+	var img *image.Image
+	if traced {
+		img, err = pipeline.TracedPlaceholder(orig)
+	} else {
+		img, err = pipeline.Placeholder(orig)
+	}
+
+	if err != nil {
+		if _, ok := err.(*pipeline.DecodeError); ok {
+			return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidImage, "failed to create placeholder: %s", err)
+		} else if _, ok := err.(*pipeline.UnsupportedError); ok {
+			return nil, service.NewError(http.StatusUnsupportedMediaType, service.CodeUnsupported, "failed to create placeholder: %s", err)
+		}
+
+		return nil, service.NewError(http.StatusInternalServerError, service.CodeProcessError, "failed to create placeholder: %s", err)
+	}
+
+	// Process image in the background, once for any number of concurrent requests for the same image.
+	key := pendingImage{src, procPath}
+	if _, pending := m.pending.LoadOrStore(key, true); !pending {
+		go func() {
+			defer m.pending.Delete(key)
+
+			// Skip images already processed.
+			if img, _ := src.Get(procPath); img != nil {
+				return
+			}
+
+			if img, err := m.transformImage(context.Background(), src, params, orig, nil, nil); err == nil {
+				src.Put(procPath, img.Data, img.Type.String())
+			}
+		}()
+	}
+
+	if wantsDataURI(r) {
+		return m.dataURI(img)
+	}
+
+	m.writeResponse(img.Data, img.Type.String(), w, r)
+	return nil, nil
+}
@@ -3,9 +3,12 @@ package ico
 import (
 	// Standard library
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	// Internal packages
@@ -19,8 +22,13 @@ import (
 // A Source represents an image source, which is usually matched against a URL endpoint, and
 // provides options related to that endpoint.
 type Source struct {
-	bucket *s3.Bucket
-	cache  *FileCache
+	bucket   *s3.Bucket
+	cache    *FileCache
+	cacheErr error
+	limit    func() *limiter
+	proc     *limiter
+	breaker  *breaker
+	lock     sync.RWMutex // Used for controlling access to settings replaced when reloading configuration.
 }
 
 // NewSource initializes a new source for region and bucket. Access is either provided by access and
@@ -44,49 +52,161 @@ func NewSource(region, bucket, accessKey, secretKey string) (*Source, error) {
 	return s, nil
 }
 
-// InitCache initializes and attaches local cache to source.
+// Returns the region and bucket name for the source, as used for identifying the source in
+// configuration.
+func (s *Source) key() string {
+	return s.bucket.Region.Name + "/" + s.bucket.Name
+}
+
+// InitCache initializes and attaches local cache to source. The source is left without a local cache
+// if the cache cannot be initialized, and the error returned is kept for reporting.
 func (s *Source) InitCache(base string, size int64) error {
 	base = path.Join(os.TempDir(), base, s.bucket.Region.Name, s.bucket.Name)
 
 	c, err := NewFileCache(base, size)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if err != nil {
+		s.cacheErr = err
 		return err
 	}
 
-	s.cache = c
+	s.cache, s.cacheErr = c, nil
 	return nil
 }
 
-// Get fetches image data from local cache or S3 bucket for this source.
+// DetachCache detaches the local cache from the source, if any, leaving files already cached in place.
+func (s *Source) DetachCache() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cache, s.cacheErr = nil, nil
+}
+
+// Returns the local cache for the source, which is nil if the source has no local cache, along with
+// the error returned when initializing the local cache, if any.
+func (s *Source) localCache() (*FileCache, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.cache, s.cacheErr
+}
+
+// Returns the limiter for processing images for the source, which is nil if the source has no limit
+// of its own.
+func (s *Source) procLimit() *limiter {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.proc
+}
+
+// Sets the maximum number of images processed concurrently for the source, where zero means no limit.
+func (s *Source) setProcLimit(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.proc = reuseLimiter(s.proc, n)
+}
+
+// Get fetches image data from local cache or S3 bucket for this source. The image type is taken
+// from the content type stored for images fetched from S3, if it corresponds to a known image type,
+// and is otherwise determined from the image data. Images that cannot be loaded as the type stored
+// for them are rejected.
 func (s *Source) Get(name string) (*image.Image, error) {
 	// Check for locally cached data.
-	if s.cache != nil {
-		if data := s.cache.Get(name); data != nil {
+	cache, _ := s.localCache()
+	if cache != nil {
+		if data := cache.Get(name); data != nil {
 			return image.New(data.([]byte))
 		}
 	}
 
-	// Get data from S3 bucket.
-	data, err := s.bucket.Get(name)
+	// Get data from S3 bucket, along with its stored content type, failing fast if S3 is unavailable.
+	if err := s.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	limit := s.limit()
+	limit.acquire()
+	data, ctype, err := s.fetch(name)
+	limit.release()
+
+	s.breaker.done(err)
 	if err != nil {
 		return nil, err
 	}
 
 	// Cache data locally.
-	if s.cache != nil {
-		s.cache.Add(name, data)
+	if cache != nil {
+		cache.Add(name, data)
 	}
 
-	return image.New(data)
+	return image.NewWithType(data, ctype)
+}
+
+// Fetches data and content type for the file pointed to by name from the S3 bucket.
+func (s *Source) fetch(name string) ([]byte, string, error) {
+	resp, err := s.bucket.GetResponse(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// ETag returns the entity tag for the file pointed to by name in the S3 bucket for this source, which
+// changes whenever the file is replaced. The local cache is not consulted.
+func (s *Source) ETag(name string) (string, error) {
+	if err := s.breaker.allow(); err != nil {
+		return "", err
+	}
+
+	limit := s.limit()
+	limit.acquire()
+	resp, err := s.bucket.Head(name, nil)
+	limit.release()
+
+	s.breaker.done(err)
+	if err != nil {
+		return "", err
+	}
+
+	resp.Body.Close()
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
 }
 
 // Put inserts data into local cache and remote S3 bucket for this source.
 func (s *Source) Put(name string, data []byte, ctype string) error {
 	// Store data locally.
-	if s.cache != nil {
-		s.cache.Add(name, data)
+	if cache, _ := s.localCache(); cache != nil {
+		cache.Add(name, data)
+	}
+
+	if err := s.breaker.allow(); err != nil {
+		return err
 	}
 
+	limit := s.limit()
+	limit.acquire()
+	err := s.store(name, data, ctype)
+	limit.release()
+
+	s.breaker.done(err)
+	return err
+}
+
+// Stores data in the S3 bucket under the name given.
+func (s *Source) store(name string, data []byte, ctype string) error {
 	// Store data in S3 bucket. The initial upload is placed with a `.tmp` prefix, and is renamed
 	// after it has uploaded successfully.
 	if err := s.bucket.Put(name+".tmp", data, ctype, "", s3.Options{}); err != nil {
@@ -106,9 +226,9 @@ func (s *Source) Put(name string, data []byte, ctype string) error {
 // Delete removes one or more files from local cache and S3 bucket for this source.
 func (s *Source) Delete(name ...string) error {
 	// Delete from local cache.
-	if s.cache != nil {
+	if cache, _ := s.localCache(); cache != nil {
 		for _, p := range name {
-			s.cache.Remove(p)
+			cache.Remove(p)
 		}
 	}
 
@@ -118,16 +238,31 @@ func (s *Source) Delete(name ...string) error {
 		objects[i].Key = strings.TrimPrefix(name[i], "/")
 	}
 
-	if err := s.bucket.DelMulti(s3.Delete{true, objects}); err != nil {
+	if err := s.breaker.allow(); err != nil {
 		return err
 	}
 
-	return nil
+	limit := s.limit()
+	limit.acquire()
+	err := s.bucket.DelMulti(s3.Delete{true, objects})
+	limit.release()
+
+	s.breaker.done(err)
+	return err
 }
 
 // ListDirs returns the full paths to any directories contained in path name.
 func (s *Source) ListDirs(name string) ([]string, error) {
+	if err := s.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	limit := s.limit()
+	limit.acquire()
 	resp, err := s.bucket.List(strings.TrimPrefix(name, "/"), "/", "", 0)
+	limit.release()
+
+	s.breaker.done(err)
 	if err != nil {
 		return nil, err
 	}
@@ -139,3 +274,12 @@ func (s *Source) ListDirs(name string) ([]string, error) {
 
 	return dirs, nil
 }
+
+// Returns true if the error provided was caused by a missing file in the S3 bucket.
+func isNotFound(err error) bool {
+	if e, ok := err.(*s3.Error); ok && e.StatusCode == http.StatusNotFound {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,77 @@
+package ico
+
+import (
+	// Standard library
+	"context"
+	"strings"
+)
+
+// A stage represents an intermediate image processed ahead of the image requested, for requests with
+// pipeline parameters given in multiple stages. The result of each stage is stored under its own path,
+// and is used as the original image for the next stage, so that it may be shared between requests.
+type stage struct {
+	params string // The pipeline parameters for the stage, with any preset resolved.
+	input  string // The path to the image the stage is processed from.
+	path   string // The path the result of the stage is stored under.
+}
+
+// Returns the pipeline parameters for any additional stages given in the image path provided, along
+// with the image path itself. Stages are given as leading path segments prefixed with '+', e.g.
+// '/+width=400/+format=webp/photos/cat.jpg', and are returned in order, without the prefix.
+func splitStages(name string) ([]string, string) {
+	var stages []string
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	for len(parts) > 1 && strings.HasPrefix(parts[0], "+") {
+		stages = append(stages, strings.TrimPrefix(parts[0], "+"))
+		parts = parts[1:]
+	}
+
+	return stages, strings.Join(parts, "/")
+}
+
+// Returns the intermediate stages for the pipeline parameters given, processed in order from the
+// image path given, along with the pipeline parameters for the final stage and the path to the image
+// the final stage is processed from. Presets are resolved for all stages.
+func (m *Ico) resolveStages(src *Source, params []string, imgPath string) ([]stage, string, string, error) {
+	var stages []stage
+	input := imgPath
+
+	for i := range params {
+		resolved, err := m.Presets.resolve(params[i])
+		if err != nil {
+			return nil, "", "", err
+		} else if i == len(params)-1 {
+			return stages, resolved, input, nil
+		}
+
+		path, err := m.cachePath(src, resolved, input)
+		if err != nil {
+			return nil, "", "", err
+		}
+
+		stages = append(stages, stage{resolved, input, path})
+		input = path
+	}
+
+	return stages, "", input, nil
+}
+
+// Processes and stores the result of each intermediate stage given, in order, unless already stored.
+func (m *Ico) processStages(ctx context.Context, src *Source, stages []stage) error {
+	for _, s := range stages {
+		if img, _ := src.Get(s.path); img != nil {
+			continue
+		}
+
+		img, err := m.transform(ctx, src, s.params, s.input, nil)
+		if err != nil {
+			return err
+		}
+
+		if err = src.Put(s.path, img.Data, img.Type.String()); err != nil {
+			return sourceError(err, "failed to store in source")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package ico
+
+import (
+	// Standard library
+	"time"
+)
+
+// The interval used for checking whether sweeping is enabled, if no valid interval has been configured.
+const defaultSweepInterval = time.Minute
+
+// Sweeps the local cache of each source periodically, removing files not accessed within the configured
+// TTL, and removing the oldest files as required for usage to fall below the configured watermark.
+// Caches otherwise only remove files when adding new files, and would keep all files while idle.
+// Configuration values are read on every check, and thus may be reloaded.
+func (m *Ico) monitorCaches() {
+	for {
+		conf := m.config()
+		interval := *conf.SweepInterval
+		if interval <= 0 {
+			time.Sleep(defaultSweepInterval)
+			continue
+		}
+
+		time.Sleep(interval)
+
+		if *conf.SweepTTL <= 0 && *conf.SweepWatermark <= 0 {
+			continue
+		}
+
+		for _, src := range m.sourceList() {
+			if cache, _ := src.localCache(); cache != nil {
+				cache.Sweep(*conf.SweepTTL, *conf.SweepWatermark)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package ico
+
+import (
+	// Standard library
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	// Internal packages
+	"github.com/deuill/mash/service"
+)
+
+// The contents of signed tokens, as accepted by ProcessToken.
+type tokenClaims struct {
+	Params  string `json:"params"` // The pipeline parameters for the image.
+	Image   string `json:"image"`  // The path to the original image.
+	Expires int64  `json:"exp"`    // The time the token expires, in seconds since the Unix epoch.
+}
+
+// ProcessToken processes the image described by the signed token in the request, in the same way as
+// for Process. Tokens contain the pipeline parameters and image path, along with an expiry time, and
+// are signed with the configured token key, so that neither may be inferred or changed by users.
+// Requests with missing, invalid or expired tokens are rejected.
+func (m *Ico) ProcessToken(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+	if err := m.checkLength(p); err != nil {
+		return nil, err
+	} else if *m.TokenKey == "" {
+		return nil, service.NewError(http.StatusForbidden, service.CodeForbidden, "signed tokens are disabled")
+	}
+
+	claims, err := parseToken(p.Get("params"), *m.TokenKey)
+	if err != nil {
+		return nil, service.NewError(http.StatusForbidden, service.CodeForbidden, "%s", err)
+	}
+
+	// Tokens are not reused past their expiry, and responses are only cached up to that time.
+	w.Header().Set("Cache-Control", fmt.Sprintf("no-transform,public,max-age=%d", claims.Expires-time.Now().Unix()))
+
+	return m.process(w, r, service.Params{{Key: "params", Value: claims.Params}, {Key: "image", Value: claims.Image}})
+}
+
+// Returns the claims contained in the token given, which is expected to be in the form of a payload
+// and signature, separated by a '.' and each encoded as URL-safe base64 without padding. The payload
+// is a JSON object, and the signature is the HMAC-SHA256 of the encoded payload, using the key given.
+// An error is returned if the token is malformed, the signature is invalid, or the token has expired.
+func parseToken(token, key string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("token is malformed")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("token is malformed")
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("token signature is invalid")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("token is malformed")
+	}
+
+	var claims tokenClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("token is malformed")
+	} else if claims.Expires <= time.Now().Unix() {
+		return nil, fmt.Errorf("token has expired")
+	}
+
+	return &claims, nil
+}
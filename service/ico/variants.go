@@ -0,0 +1,197 @@
+package ico
+
+import (
+	// Standard library
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	// Internal packages
+	"github.com/deuill/mash/service"
+	"github.com/deuill/mash/service/ico/image"
+	"github.com/deuill/mash/service/ico/pipeline"
+)
+
+// A Variant represents an image processed for a specific width or region, as part of a responsive set
+// or a set of regions extracted from the same image.
+type Variant struct {
+	Width  int64  `json:"width,omitempty"`  // The width requested for the processed image, if any.
+	Region string `json:"region,omitempty"` // The region extracted for the processed image, if any.
+	Path   string `json:"path"`             // The request path under which the processed image is available.
+}
+
+// The default maximum number of variants processed for a single request.
+const defaultMaxVariants = 100
+
+// The maximum size for JSON request bodies listing widths, regions or images, in bytes.
+const maxListBody = 1 << 20
+
+// Matches regions given as 'x:y:width:height', as accepted by the 'extract' pipeline parameter.
+var validRegion = regexp.MustCompile(`^[0-9]+:[0-9]+:[0-9]+:[0-9]+$`)
+
+// Variants processes the image pointed to by the request for each width and region provided in the
+// request body, using the pipeline parameters in the request for all other options, and returns a list
+// of request paths for the processed images, e.g. for use in 'srcset' attributes. The request body is
+// expected to contain a JSON object with a 'widths' field, containing a list of image widths, and a
+// 'regions' field, containing a list of regions to extract, either of which may be empty. Each region
+// is processed at each width, if both are given. The original image is fetched and decoded only once
+// for all variants requested.
+func (m *Ico) Variants(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+	if err := m.checkLength(p); err != nil {
+		return nil, err
+	}
+
+	// Get source for this request, pulling the region and bucket names from request headers.
+	src, err := m.requestSource(w, r)
+	if err != nil {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeSourceError, "%s", err)
+	}
+
+	params, err := m.Presets.resolve(p.Get("params"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Variant paths are returned as requested, and may differ from image paths in the S3 bucket.
+	reqPath, err := cleanPath(p.Get("image"))
+	if err != nil {
+		return nil, err
+	}
+
+	imgPath, err := m.sourcePath(src, reqPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Widths  []int64  `json:"widths"`
+		Regions []string `json:"regions"`
+	}
+
+	if err = decodeList(r, &body); err != nil {
+		return nil, err
+	} else if len(body.Widths) == 0 && len(body.Regions) == 0 {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "lists of widths and regions are unset or empty")
+	}
+
+	for _, width := range body.Widths {
+		if width <= 0 {
+			return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "width '%d' is not a positive integer", width)
+		}
+	}
+
+	for _, region := range body.Regions {
+		if !validRegion.MatchString(region) {
+			return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "region '%s' is not in the form 'x:y:width:height'", region)
+		}
+	}
+
+	// Variants are produced for each combination of width and region, and widths or regions left
+	// unset keep the values given in the pipeline parameters, if any.
+	widths, regions := body.Widths, body.Regions
+	if len(widths) == 0 {
+		widths = []int64{0}
+	}
+
+	if len(regions) == 0 {
+		regions = []string{""}
+	}
+
+	// List lengths are bounded by the maximum size of the request body, and their product cannot
+	// overflow.
+	if n := len(widths) * len(regions); *m.MaxVariants > 0 && n > *m.MaxVariants {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "number of variants requested (%d) exceeds the maximum of %d", n, *m.MaxVariants)
+	}
+
+	variants := make([]Variant, 0, len(widths)*len(regions))
+
+	// Original image is fetched and decoded lazily, as all variants requested may already have been
+	// processed.
+	var orig *image.Image
+	var dec *pipeline.Decoded
+
+	for _, region := range regions {
+		for _, width := range widths {
+			vparams := variantParams(params, width, region)
+			procPath, err := m.cachePath(src, vparams, imgPath)
+			if err != nil {
+				return nil, err
+			}
+
+			variants = append(variants, Variant{width, region, path.Join("/ico", vparams, reqPath)})
+
+			// Skip variants already processed.
+			if img, _ := src.Get(procPath); img != nil {
+				continue
+			}
+
+			if orig == nil {
+				m.refreshOriginal(src, imgPath)
+				if orig, err = src.Get(imgPath); err != nil {
+					return nil, sourceError(err, "failed to fetch from source")
+				}
+
+				// Vector images are rendered at the size required for each variant, and are not decoded.
+				if orig.Type != image.SVG {
+					if dec, err = pipeline.Decode(orig); err != nil {
+						return nil, service.NewError(http.StatusBadRequest, service.CodeInvalidImage, "failed to process image: %s", err)
+					}
+
+					defer dec.Close()
+				}
+			}
+
+			img, err := m.transformImage(r.Context(), src, vparams, orig, dec, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			src.Put(procPath, img.Data, img.Type.String())
+		}
+	}
+
+	return &service.Response{http.StatusOK, map[string][]Variant{"variants": variants}}, nil
+}
+
+// Decodes the JSON object in the request body into the value given, rejecting request bodies larger
+// than the maximum size for lists.
+func decodeList(r *http.Request, v interface{}) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxListBody+1))
+	if err != nil {
+		return service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "failed to read request body: %s", err)
+	} else if len(data) > maxListBody {
+		return service.NewError(http.StatusRequestEntityTooLarge, service.CodeInvalidParams, "request body is larger than the maximum of %d bytes", maxListBody)
+	} else if err = json.Unmarshal(data, v); err != nil {
+		return service.NewError(http.StatusBadRequest, service.CodeInvalidParams, "failed to decode request body: %s", err)
+	}
+
+	return nil
+}
+
+// Returns the pipeline parameters given with the width and extract parameters replaced by the width
+// and region provided. Parameters are left unchanged for a zero width or empty region.
+func variantParams(params string, width int64, region string) string {
+	var result []string
+	for _, p := range strings.Split(params, ",") {
+		if p == "" || (width > 0 && strings.HasPrefix(p, "width=")) || (region != "" && strings.HasPrefix(p, "extract=")) {
+			continue
+		}
+
+		result = append(result, p)
+	}
+
+	if region != "" {
+		result = append(result, "extract="+region)
+	}
+
+	if width > 0 {
+		result = append(result, "width="+strconv.FormatInt(width, 10))
+	}
+
+	return strings.Join(result, ",")
+}
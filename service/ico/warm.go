@@ -0,0 +1,143 @@
+package ico
+
+import (
+	// Standard library
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	// Internal packages
+	"github.com/deuill/mash/service"
+)
+
+// A WarmJob represents a list of images processed ahead of time, in order to populate the local and
+// remote caches, along with the progress made in processing these images.
+type WarmJob struct {
+	Total  int      `json:"total"`  // The total number of images to process.
+	Done   int      `json:"done"`   // The number of images processed, successfully or not.
+	Failed int      `json:"failed"` // The number of images that failed to process.
+	Errors []string `json:"errors"` // The errors for any images that failed to process.
+
+	sync.Mutex // Used for controlling concurrent access to job progress.
+}
+
+// Warm begins processing the list of images provided in the request body, for the source selected
+// by the request. The request body is expected to contain a JSON object with an 'images' field,
+// containing a list of image paths along with their pipeline parameters, in the same form used in
+// requests to Process, e.g. 'width=500,fit=crop/header/promo/kittens-hats.jpg'. Images are processed
+// asynchronously, and progress can be checked via WarmStatus. Requests made while images submitted
+// previously are still being processed are rejected.
+func (m *Ico) Warm(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+	src, err := m.requestSource(w, r)
+	if err != nil {
+		return nil, service.NewError(http.StatusBadRequest, service.CodeSourceError, "%s", err)
+	}
+
+	var body struct {
+		Images []string `json:"images"`
+	}
+
+	if err = decodeList(r, &body); err != nil {
+		return nil, err
+	}
+
+	job := &WarmJob{Total: len(body.Images), Errors: []string{}}
+
+	// Only a single job is run at a time, as progress is only kept for the most recent job.
+	m.warmLock.Lock()
+	if m.warm != nil && m.warm.running() {
+		m.warmLock.Unlock()
+		return nil, service.NewError(http.StatusConflict, service.CodeConflict, "images submitted previously are still being processed")
+	}
+
+	m.warm = job
+	m.warmLock.Unlock()
+
+	go m.runWarmJob(job, src, body.Images)
+
+	return &service.Response{http.StatusAccepted, map[string]int{"total": job.Total}}, nil
+}
+
+// WarmStatus returns the progress made for the most recent list of images submitted via Warm.
+func (m *Ico) WarmStatus(w http.ResponseWriter, r *http.Request, p service.Params) (*service.Response, error) {
+	m.warmLock.Lock()
+	job := m.warm
+	m.warmLock.Unlock()
+
+	if job == nil {
+		return nil, service.NewError(http.StatusNotFound, service.CodeNotFound, "no images submitted for processing")
+	}
+
+	job.Lock()
+	defer job.Unlock()
+
+	status := map[string]interface{}{
+		"total":  job.Total,
+		"done":   job.Done,
+		"failed": job.Failed,
+		"errors": append([]string{}, job.Errors...),
+	}
+
+	return &service.Response{http.StatusOK, status}, nil
+}
+
+// Returns true if the job has images left to process.
+func (job *WarmJob) running() bool {
+	job.Lock()
+	defer job.Unlock()
+
+	return job.Done < job.Total
+}
+
+// Processes list of images for job in sequence, skipping images that have already been processed.
+func (m *Ico) runWarmJob(job *WarmJob, src *Source, images []string) {
+	for _, name := range images {
+		err := m.warmImage(src, name)
+
+		job.Lock()
+		job.Done++
+		if err != nil {
+			job.Failed++
+			job.Errors = append(job.Errors, fmt.Sprintf("%s: %s", name, err))
+		}
+		job.Unlock()
+	}
+}
+
+// Processes and stores a single image, as described by the parameters and path given.
+func (m *Ico) warmImage(src *Source, name string) error {
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("malformed image path, expected parameters followed by path")
+	}
+
+	imgPath, err := m.sourcePath(src, parts[1])
+	if err != nil {
+		return err
+	}
+
+	params, err := m.Presets.resolve(parts[0])
+	if err != nil {
+		return err
+	}
+
+	procPath, err := m.cachePath(src, params, imgPath)
+	if err != nil {
+		return err
+	}
+
+	// Skip images already processed.
+	if img, _ := src.Get(procPath); img != nil {
+		return nil
+	}
+
+	m.refreshOriginal(src, imgPath)
+	img, err := m.transform(context.Background(), src, params, imgPath, nil)
+	if err != nil {
+		return err
+	}
+
+	return src.Put(procPath, img.Data, img.Type.String())
+}
@@ -2,11 +2,17 @@ package service
 
 import (
 	// Standard library
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	// Third-party packages
 	"github.com/julienschmidt/httprouter"
@@ -14,11 +20,39 @@ import (
 )
 
 var (
-	port     *string            // The port number on which the internal HTTP service will listen.
-	services map[string]bool    // A map of services indexed under their name.
-	router   *httprouter.Router // The default router for all incoming requests.
+	current  atomic.Value        // The configuration currently in use for the service host, as a *config.
+	services map[string][]Route  // A map of routes for each service, indexed under the service name.
+	router   *httprouter.Router  // The default router for all incoming requests.
+	server   *http.Server        // The internal HTTP service, if initialized.
+	address  string              // The address the internal HTTP service was initialized on.
+	reloads  []ReloadFunc        // A list of functions to call on configuration reload.
+	infos    map[string]InfoFunc // A map of functions returning service information, indexed by name.
 )
 
+// Configuration for the service host, which is never changed once parsed, and is replaced as a whole
+// whenever configuration is reloaded.
+type config struct {
+	listen     *string // The address on which the internal HTTP service will listen.
+	port       *string // The port number on which the internal HTTP service will listen.
+	adminToken *string // The token required for accessing administrative handlers. Handlers are disabled if empty.
+}
+
+// Returns a new configuration for the service host, along with the flag set its values are parsed
+// from. Configuration values are set to their defaults until parsed.
+func newConfig() (*config, *flag.FlagSet) {
+	fs := flag.NewFlagSet("http", flag.ContinueOnError)
+	return &config{
+		listen:     fs.String("listen", "", ""),
+		adminToken: fs.String("admin-token", "", ""),
+		port:       fs.String("port", "6116", ""),
+	}, fs
+}
+
+// Returns the configuration currently in use for the service host.
+func getConfig() *config {
+	return current.Load().(*config)
+}
+
 // Response represents a JSON response, containing a response code and serialise-able data.
 type Response struct {
 	Code int         // The HTTP response code.
@@ -35,6 +69,25 @@ type Handler struct {
 	Handle HandleFunc // The method to use for this handler.
 }
 
+// Route represents a request method and path a service handler has been mounted under.
+type Route struct {
+	Method string `json:"method"` // The HTTP method for the route, e.g. GET, POST, DELETE etc.
+	Path   string `json:"path"`   // The full request path for the route, including the service name.
+}
+
+// A ParseFunc parses configuration values for the section named into the flag set given.
+type ParseFunc func(name string, flags *flag.FlagSet)
+
+// A ReloadFunc is called whenever configuration is loaded or reloaded, and is given the function used
+// for parsing configuration values. Services are expected to parse values into a new flag set, bound to
+// new variables, and to replace the variables in use only once parsed, so that values are never changed
+// while in use by requests.
+type ReloadFunc func(parse ParseFunc) error
+
+// An InfoFunc returns information on the state and capabilities of a service, and is called for
+// each request to the service host information endpoint.
+type InfoFunc func() interface{}
+
 // Params are attached to methods according to their path declarations, and may contain values
 // corresponding to named parameters declared on those paths.
 type Params httprouter.Params
@@ -45,71 +98,193 @@ func (p Params) Get(name string) string {
 	return httprouter.Params(p).ByName(name)
 }
 
-// Register service for use with Mash.
+// Register service for use with Mash. Any flags given are parsed once, when configuration is first
+// loaded, and services with configuration values that may be reloaded are expected to parse them via
+// a function registered with OnReload instead.
 func Register(name string, flags *flag.FlagSet, handlers []Handler) error {
 	if _, exists := services[name]; exists {
 		return fmt.Errorf("Service '%s' already exists, refusing to overwrite", name)
 	}
 
-	services[name] = true
+	services[name] = make([]Route, 0, len(handlers))
 
 	if flags != nil {
 		globalconf.Register(name, flags)
 	}
 
 	for _, h := range handlers {
-		handle := h.Handle
-		call := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-			if result, err := handle(w, r, Params(p)); err != nil {
-				respond(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
-			} else if result != nil {
-				respond(w, result.Code, result.Data)
-			}
-		}
-
 		path := "/" + name + h.Path
-		router.Handle(h.Method, path, call)
+		router.Handle(h.Method, path, wrap(h.Handle))
+		services[name] = append(services[name], Route{h.Method, path})
 	}
 
 	return nil
 }
 
-// Encode response in JSON and write to connection.
-func respond(w http.ResponseWriter, code int, data interface{}) {
-	// All responses are sent in UTF8-encoded JSON.
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(code)
+// Wraps handler method for use with the router, encoding any results returned in JSON.
+func wrap(handle HandleFunc) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if result, err := handle(w, r, Params(p)); err != nil {
+			code, body := errorResponse(err)
+			respond(w, r, code, body)
+		} else if result != nil {
+			respond(w, r, result.Code, result.Data)
+		}
+	}
+}
+
+// OnReload registers a function to be called whenever configuration is loaded or reloaded.
+func OnReload(fn ReloadFunc) {
+	reloads = append(reloads, fn)
+}
+
+// OnInfo registers a function returning information for the service, which will be made available
+// under the service name in the service host information endpoint.
+func OnInfo(name string, fn InfoFunc) {
+	infos[name] = fn
+}
+
+// Returns information on all registered services.
+func info(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	data := make(map[string]interface{})
+	for name := range services {
+		data[name] = nil
+		if fn, exists := infos[name]; exists {
+			data[name] = fn()
+		}
+	}
+
+	respond(w, r, http.StatusOK, map[string]interface{}{"services": data})
+}
 
+// Returns the list of routes mounted for all registered services.
+func routes(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	respond(w, r, http.StatusOK, map[string]interface{}{"services": services})
+}
+
+// Encode response in JSON and write to connection. Responses to HEAD requests have their headers
+// written, including the length of the encoded response, without the response body.
+func respond(w http.ResponseWriter, r *http.Request, code int, data interface{}) {
+	// Encode data before writing any headers, so that we are able to respond with a valid error if
+	// encoding fails. The error body is built from known-good types and cannot fail to encode.
 	b, err := json.Marshal(data)
 	if err != nil {
-		fmt.Fprintf(w, `{error: "%s"}`, err)
-		return
+		code = http.StatusInternalServerError
+		b, _ = json.Marshal(map[string]string{"error": err.Error(), "code": CodeError})
 	}
 
-	w.Write(append(b, '\n'))
-	return
+	// All responses are sent in UTF8-encoded JSON.
+	b = append(b, '\n')
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(code)
+
+	if r.Method != "HEAD" {
+		w.Write(b)
+	}
 }
 
 // Initialize service host, including internal HTTP service.
 func Init() error {
-	ln, err := net.Listen("tcp", net.JoinHostPort("", *port))
+	addr := listenAddr()
+	address = addr
+
+	network := "tcp"
+
+	// Addresses with a 'unix:' scheme are treated as paths to Unix domain sockets. Any stale socket
+	// file left behind by a previous instance is removed before listening.
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
 
-	go http.Serve(ln, router)
+	server = &http.Server{Handler: router}
+	go server.Serve(ln)
 
 	return nil
 }
 
+// Reload parses configuration values with the function given, and applies them to the service host
+// and all registered services. Reload is called once configuration is first loaded, before calling
+// Init, and again whenever configuration is reloaded. Changes to settings that cannot be applied
+// without a restart, such as the listen address, are returned as errors.
+func Reload(parse ParseFunc) error {
+	var errs []string
+
+	conf, fs := newConfig()
+	parse("http", fs)
+	current.Store(conf)
+
+	for _, fn := range reloads {
+		if err := fn(parse); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if addr := listenAddr(); server != nil && addr != address {
+		errs = append(errs, fmt.Sprintf("listen address changed from '%s' to '%s', restart required", address, addr))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+
+	return nil
+}
+
+// The maximum time to wait for active requests to complete when shutting down.
+const shutdownTimeout = 30 * time.Second
+
+// Shutdown stops the internal HTTP service from accepting new connections, removing any Unix domain
+// socket file created on initialization, and waits for active requests to complete, up to a timeout.
+// Connections still active once the timeout expires are closed, and an error is returned.
+func Shutdown() error {
+	if server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		server.Close()
+	}
+
+	server = nil
+	return err
+}
+
+// Returns the configured address for the internal HTTP service. If no full address has been given,
+// all interfaces are listened on for the configured port.
+func listenAddr() string {
+	conf := getConfig()
+	if *conf.listen != "" {
+		return *conf.listen
+	}
+
+	return net.JoinHostPort("", *conf.port)
+}
+
 // Initialize internal resources and configuration variables.
 func init() {
 	router = httprouter.New()
-	services = make(map[string]bool)
+	services = make(map[string][]Route)
+	infos = make(map[string]InfoFunc)
 
-	// Define configuration variables used for the HTTP service.
-	fs := flag.NewFlagSet("http", flag.ContinueOnError)
-	port = fs.String("port", "6116", "")
+	// Register information endpoints for service host.
+	router.GET("/info", info)
+	router.GET("/services", routes)
+	router.GET("/version", version)
 
-	globalconf.Register("http", fs)
+	// Use default configuration values for the HTTP service until configuration is loaded.
+	conf, _ := newConfig()
+	current.Store(conf)
 }
@@ -0,0 +1,71 @@
+package service
+
+import (
+	// Standard library
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A lookup table of size unit suffixes against their size in bytes.
+var sizeUnits = map[string]int64{
+	"": 1, "B": 1,
+	"K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+	"M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+	"G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+	"T": 1 << 40, "TB": 1 << 40, "TIB": 1 << 40,
+}
+
+// Size represents a size in bytes, and can be used as a configuration variable accepting both plain
+// byte counts and human-readable sizes, e.g. '128MB' or '1GB'. Units are powers of 1024. The value
+// 'unlimited' may be used for sizes with no upper limit.
+type Size int64
+
+// Unlimited represents a size with no upper limit.
+const Unlimited Size = -1
+
+// Set parses a size from the value provided, and is used for setting the size from configuration.
+func (s *Size) Set(value string) error {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	if v == "UNLIMITED" {
+		*s = Unlimited
+		return nil
+	}
+
+	// Find where the numeric part of the value ends and the unit begins.
+	i := strings.IndexFunc(v, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(v)
+	}
+
+	num, unit := v[:i], strings.TrimSpace(v[i:])
+
+	mul, ok := sizeUnits[unit]
+	if !ok {
+		return fmt.Errorf("unknown unit in size '%s'", value)
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return fmt.Errorf("unable to parse size '%s': %s", value, err)
+	}
+
+	// Sizes are rejected if not representable in bytes, as converting these would overflow.
+	size := n * float64(mul)
+	if math.IsNaN(size) || math.IsInf(size, 0) || size >= math.MaxInt64 {
+		return fmt.Errorf("size '%s' is too large", value)
+	}
+
+	*s = Size(size)
+	return nil
+}
+
+// String returns the size in bytes, as a string, or 'unlimited' for sizes with no upper limit.
+func (s *Size) String() string {
+	if *s < 0 {
+		return "unlimited"
+	}
+
+	return strconv.FormatInt(int64(*s), 10)
+}
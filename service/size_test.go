@@ -0,0 +1,93 @@
+package service
+
+import (
+	// Standard library
+	"strings"
+	"testing"
+)
+
+func TestSizeSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Size
+		err   bool
+	}{
+		// Plain byte counts.
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{" 512 ", 512, false},
+
+		// Units, as powers of 1024, in any letter case and with optional spacing.
+		{"1B", 1, false},
+		{"2K", 2 << 10, false},
+		{"2KB", 2 << 10, false},
+		{"2KiB", 2 << 10, false},
+		{"128MB", 128 << 20, false},
+		{"128 mb", 128 << 20, false},
+		{"1.5G", 3 << 29, false},
+		{"1GiB", 1 << 30, false},
+		{"2TB", 2 << 40, false},
+		{"0MB", 0, false},
+
+		// Sizes with no upper limit.
+		{"unlimited", Unlimited, false},
+		{"Unlimited", Unlimited, false},
+		{" UNLIMITED ", Unlimited, false},
+
+		// Negative values.
+		{"-1", 0, true},
+		{"-128MB", 0, true},
+
+		// Malformed values.
+		{"", 0, true},
+		{"MB", 0, true},
+		{"128XB", 0, true},
+		{"128 M B", 0, true},
+		{"1.2.3MB", 0, true},
+		{"unlimitedMB", 0, true},
+		{"0x10", 0, true},
+
+		// Values too large to be represented in bytes, or not representing any finite number.
+		{"8388607TB", Size(8388607 << 40), false},
+		{"8388608TB", 0, true},
+		{"9223372036854775808", 0, true},
+		{"1" + strings.Repeat("0", 400), 0, true},
+		{"NaN", 0, true},
+		{"Inf", 0, true},
+		{"+Inf", 0, true},
+	}
+
+	for _, tt := range tests {
+		var s Size
+		err := s.Set(tt.value)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Set(%q) = %d, want error", tt.value, s)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Set(%q) returned error: %s", tt.value, err)
+		} else if s != tt.want {
+			t.Errorf("Set(%q) = %d, want %d", tt.value, s, tt.want)
+		}
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	tests := []struct {
+		size Size
+		want string
+	}{
+		{0, "0"},
+		{1 << 20, "1048576"},
+		{Unlimited, "unlimited"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.size.String(); got != tt.want {
+			t.Errorf("Size(%d).String() = %q, want %q", int64(tt.size), got, tt.want)
+		}
+	}
+}
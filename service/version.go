@@ -0,0 +1,27 @@
+package service
+
+import (
+	// Standard library
+	"net/http"
+
+	// Third-party packages
+	"github.com/julienschmidt/httprouter"
+)
+
+// BuildInfo describes the build of the running binary, along with the versions of any libraries
+// linked by services, which may affect their capabilities.
+type BuildInfo struct {
+	Version   string            `json:"version"`   // The release version, e.g. '1.2.0'.
+	Commit    string            `json:"commit"`    // The source control commit built from.
+	Date      string            `json:"date"`      // The time the binary was built at.
+	Libraries map[string]string `json:"libraries"` // The versions of linked libraries, indexed by name.
+}
+
+// Build contains information on the build of the running binary, as set on startup, and is exposed
+// under the '/version' endpoint. Services may add versions of libraries they link to on registration.
+var Build = BuildInfo{Version: "unknown", Libraries: make(map[string]string)}
+
+// Returns build information for the running binary.
+func version(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	respond(w, r, http.StatusOK, Build)
+}